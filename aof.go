@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultAOFFilename is the name of the append-only file in the data
+// directory.
+const defaultAOFFilename = "appendonly.aof"
+
+// AOF fsync policies, as in Redis' appendfsync.
+const (
+	aofFsyncAlways   = "always"
+	aofFsyncEverysec = "everysec"
+	aofFsyncNo       = "no"
+)
+
+// aof appends applied write commands to a file as RESP, giving an
+// auditable record of writes and an alternative recovery path.
+//
+// Raft does not persist which entries have been applied, so a restarted
+// node applies its log since the last snapshot again. To record each
+// write once, the write index of the last command recorded is kept next
+// to the file, in indexFile, and writes up to it are skipped.
+type aof struct {
+	mu      sync.Mutex
+	path    string
+	fsync   string
+	maxSize int64
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	buf     []byte
+	done    chan struct{}
+
+	index     *os.File
+	last      uint64 // write index of the last command recorded
+	lastSaved uint64 // last as saved in index
+}
+
+// aofIndexSize is the size of the index file: the write index as 20
+// zero-padded decimal digits and a newline, rewritten in place.
+const aofIndexSize = 21
+
+// aofIndexPath returns the path of the index file of the append-only file
+// at path: appendonly.index for appendonly.aof.
+func aofIndexPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".index"
+}
+
+// openAOF opens the append-only file at path, appending to any previous
+// one. fsync is one of always, everysec or no; maxSize is the size at
+// which the file is rotated, or zero to never rotate.
+func openAOF(path, fsync string, maxSize int64) (*aof, error) {
+	switch fsync {
+	case aofFsyncAlways, aofFsyncEverysec, aofFsyncNo:
+	default:
+		return nil, fmt.Errorf("invalid appendfsync policy %q", fsync)
+	}
+	a := &aof{
+		path:    path,
+		fsync:   fsync,
+		maxSize: maxSize,
+		done:    make(chan struct{}),
+	}
+	if err := a.openIndex(); err != nil {
+		return nil, err
+	}
+	if err := a.open(); err != nil {
+		a.index.Close()
+		return nil, err
+	}
+	if fsync != aofFsyncAlways {
+		go a.flushLoop()
+	}
+	return a, nil
+}
+
+// openIndex opens the index file and reads the write index of the last
+// command recorded. A missing file means none was.
+func (a *aof) openIndex() error {
+	f, err := os.OpenFile(aofIndexPath(a.path), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, aofIndexSize)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return err
+	}
+	if n > 0 {
+		a.last, err = strconv.ParseUint(strings.TrimSpace(string(buf[:n])), 10, 64)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("invalid append-only file index %q", buf[:n])
+		}
+	}
+	a.index = f
+	a.lastSaved = a.last
+	return nil
+}
+
+func (a *aof) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f = f
+	a.w = bufio.NewWriter(f)
+	a.size = fi.Size()
+	return nil
+}
+
+// flushLoop flushes the buffered commands once a second, syncing them to
+// disk under the everysec policy.
+func (a *aof) flushLoop() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-t.C:
+			a.mu.Lock()
+			if err := a.flush(a.fsync == aofFsyncEverysec); err != nil {
+				log.Warningf("could not flush append-only file: %v", err)
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+// flush writes the buffered commands to the file, and then their write
+// index to the index file, so that the index never runs ahead of the file.
+// A crash in between leaves commands that are recorded again after the
+// restart; replaying a stretch of SET and DEL commands twice in a row
+// gives the same data.
+func (a *aof) flush(sync bool) error {
+	if err := a.w.Flush(); err != nil {
+		return err
+	}
+	if sync {
+		if err := a.f.Sync(); err != nil {
+			return err
+		}
+	}
+	if a.last == a.lastSaved {
+		return nil
+	}
+	if _, err := a.index.WriteAt([]byte(fmt.Sprintf("%020d\n", a.last)), 0); err != nil {
+		return err
+	}
+	if sync {
+		if err := a.index.Sync(); err != nil {
+			return err
+		}
+	}
+	a.lastSaved = a.last
+	return nil
+}
+
+// Append writes the command with write index index to the file, unless a
+// command with that index or a later one was recorded already.
+func (a *aof) Append(index uint64, args [][]byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if index <= a.last {
+		return nil
+	}
+	a.last = index
+	if err := a.write(args); err != nil {
+		return err
+	}
+	if a.fsync == aofFsyncAlways {
+		if err := a.flush(true); err != nil {
+			return err
+		}
+	}
+	if a.maxSize > 0 && a.size >= a.maxSize {
+		return a.rotate()
+	}
+	return nil
+}
+
+// write buffers a command for the file. The caller must hold a.mu.
+func (a *aof) write(args [][]byte) error {
+	a.buf = appendCommand(a.buf[:0], args)
+	n, err := a.w.Write(a.buf)
+	a.size += int64(n)
+	return err
+}
+
+// NeedsRewrite reports whether restoring a snapshot taken at write index
+// index leaves the file behind: it misses some of the writes the snapshot
+// has, or it has recorded nothing yet.
+func (a *aof) NeedsRewrite(index uint64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return index > a.last || a.last == 0 && a.size == 0
+}
+
+// Rewrite starts a new file holding the dataset of a snapshot taken at
+// write index index, which fn writes with record. The current file is
+// rotated first, unless it is empty, so that no file holds both its old
+// commands and the snapshot's dataset, which is kept in one file however
+// big it is. fn's error is returned; failures to write the file are only
+// logged.
+func (a *aof) Rewrite(index uint64, fn func(record func(args [][]byte)) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var werr error
+	if a.size > 0 || a.w.Buffered() > 0 {
+		werr = a.rotate()
+	}
+	a.last = index
+	err := fn(func(args [][]byte) {
+		if werr == nil {
+			werr = a.write(args)
+		}
+	})
+	if werr == nil {
+		werr = a.flush(true)
+	}
+	if werr != nil {
+		log.Warningf("could not rewrite append-only file: %v", werr)
+	}
+	return err
+}
+
+// rotate moves the current file aside, suffixed with the current time,
+// and starts a new one.
+func (a *aof) rotate() error {
+	if err := a.flush(true); err != nil {
+		return err
+	}
+	if err := a.f.Close(); err != nil {
+		return err
+	}
+	rotated := a.path + "." + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := os.Rename(a.path, rotated); err != nil {
+		return err
+	}
+	log.Infof("rotated append-only file to %s", rotated)
+	return a.open()
+}
+
+// Close flushes and syncs the file and closes it.
+func (a *aof) Close() error {
+	close(a.done)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := a.flush(true)
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := a.index.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// appendCommand appends args to buf as a RESP array of bulk strings.
+func appendCommand(buf []byte, args [][]byte) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
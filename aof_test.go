@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAOF(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "bitraft")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, defaultAOFFilename)
+	a, err := openAOF(path, aofFsyncAlways, 48)
+	assert.NoError(err)
+
+	assert.NoError(a.Append(1, [][]byte{[]byte("SET"), []byte("foo"), []byte("bar")}))
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n", string(data))
+	data, err = ioutil.ReadFile(filepath.Join(dir, "appendonly.index"))
+	assert.NoError(err)
+	assert.Equal("00000000000000000001\n", string(data))
+
+	// A command already recorded is skipped.
+	assert.NoError(a.Append(1, [][]byte{[]byte("SET"), []byte("foo"), []byte("bar")}))
+
+	// The second command takes the file past 48 bytes and rotates it.
+	assert.NoError(a.Append(2, [][]byte{[]byte("DEL"), []byte("foo")}))
+	assert.NoError(a.Close())
+
+	matches, err := filepath.Glob(path + ".*")
+	assert.NoError(err)
+	if assert.Len(matches, 1) {
+		data, err = ioutil.ReadFile(matches[0])
+		assert.NoError(err)
+		assert.Equal("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n*2\r\n$3\r\nDEL\r\n$3\r\nfoo\r\n", string(data))
+	}
+
+	// The index survives a restart.
+	a, err = openAOF(path, aofFsyncNo, 0)
+	assert.NoError(err)
+	assert.Equal(uint64(2), a.last)
+	assert.NoError(a.Append(2, [][]byte{[]byte("DEL"), []byte("foo")}))
+	assert.NoError(a.Append(3, [][]byte{[]byte("DEL"), []byte("bar")}))
+	assert.NoError(a.Close())
+	data, err = ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal("*2\r\n$3\r\nDEL\r\n$3\r\nbar\r\n", string(data))
+
+	_, err = openAOF(path, "sometimes", 0)
+	assert.Error(err)
+}
+
+func TestAOFRestart(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "bitraft")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, defaultAOFFilename)
+	opts := &Options{AppendOnly: true, AppendFsync: aofFsyncAlways}
+	conn := &testConn{}
+
+	kvm, err := NewMachine(dir, "127.0.0.1:4920", opts)
+	assert.NoError(err)
+	do(kvm, conn, "set", "a", "1")
+	var snapshot bytes.Buffer
+	assert.NoError(kvm.Snapshot(&snapshot))
+	do(kvm, conn, "set", "b", "2")
+	assert.NoError(kvm.Close())
+
+	// After a restart Raft restores its last snapshot and applies the log
+	// since then again. Only the new write is recorded.
+	kvm, err = NewMachine(dir, "127.0.0.1:4920", opts)
+	assert.NoError(err)
+	assert.NoError(kvm.Restore(&snapshot))
+	do(kvm, conn, "set", "b", "2")
+	do(kvm, conn, "set", "c", "3")
+	assert.NoError(kvm.Close())
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal("*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"+
+		"*3\r\n$3\r\nset\r\n$1\r\nb\r\n$1\r\n2\r\n"+
+		"*3\r\n$3\r\nset\r\n$1\r\nc\r\n$1\r\n3\r\n", string(data))
+	matches, err := filepath.Glob(path + ".*")
+	assert.NoError(err)
+	assert.Len(matches, 0)
+}
+
+func TestAOFRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	src, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+	do(src, conn, "set", "foo", "1")
+	do(src, conn, "set", "foo", "bar")
+	var buf bytes.Buffer
+	assert.NoError(src.Snapshot(&buf))
+
+	dir, err := ioutil.TempDir("", "bitraft")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, defaultAOFFilename)
+	dst, err := NewMachine(dir, "127.0.0.1:4920", &Options{AppendOnly: true, AppendFsync: aofFsyncAlways})
+	assert.NoError(err)
+	do(dst, conn, "set", "old", "1")
+
+	// The snapshot is ahead of the file, which is rotated and restarted
+	// from the snapshot's dataset.
+	assert.NoError(dst.Restore(&buf))
+	do(dst, conn, "set", "new", "1")
+	assert.NoError(dst.Close())
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"+
+		"*3\r\n$3\r\nset\r\n$3\r\nnew\r\n$1\r\n1\r\n", string(data))
+	matches, err := filepath.Glob(path + ".*")
+	assert.NoError(err)
+	if assert.Len(matches, 1) {
+		data, err = ioutil.ReadFile(matches[0])
+		assert.NoError(err)
+		assert.Equal("*3\r\n$3\r\nset\r\n$3\r\nold\r\n$1\r\n1\r\n", string(data))
+	}
+	data, err = ioutil.ReadFile(filepath.Join(dir, "appendonly.index"))
+	assert.NoError(err)
+	assert.Equal("00000000000000000003\n", string(data))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// feedBacklog is how many changes a CHANGEFEED subscriber may fall behind
+// before it is disconnected.
+const feedBacklog = 1024
+
+// feedHistory is how many of the latest changes are kept for CHANGEFEED
+// subscribers starting from an index.
+const feedHistory = 4096
+
+// errFeedTooOld is returned for CHANGEFEED from an index whose change is no
+// longer buffered.
+func errFeedTooOld(start, oldest uint64) error {
+	return &respError{"ERR", fmt.Sprintf("index %d is no longer buffered, "+
+		"the oldest change available is %d: catch up with EXPORT SINCE", start, oldest)}
+}
+
+// A change is an applied write and its write index.
+type change struct {
+	index uint64
+	args  [][]byte
+}
+
+// changefeed fans applied writes out to CHANGEFEED subscribers and keeps
+// the latest feedHistory of them for subscribers starting from an index.
+// Writes are published in commit order with their write index (see
+// Machine.index), which is the same on every node.
+type changefeed struct {
+	mu      sync.Mutex
+	last    uint64   // index of the last change published
+	history []change // ring buffer of the latest changes
+	next    int      // position in history of the next change
+	subs    map[chan change]uint64
+}
+
+// publish sends the applied write numbered index to every subscriber
+// starting at or before it, dropping subscribers that have fallen
+// feedBacklog changes behind.
+func (f *changefeed) publish(index uint64, args [][]byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// args refers to the connection's read buffer, which is reused.
+	c := change{index: index, args: make([][]byte, len(args))}
+	for i, arg := range args {
+		c.args[i] = append([]byte(nil), arg...)
+	}
+	f.last = index
+	if len(f.history) < feedHistory {
+		f.history = append(f.history, c)
+	} else {
+		f.history[f.next] = c
+	}
+	f.next = (f.next + 1) % feedHistory
+	for ch, start := range f.subs {
+		if index < start {
+			continue
+		}
+		select {
+		case ch <- c:
+		default:
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// reset forgets the buffered changes and ends every subscription, as the
+// write index jumped to index, as when a snapshot is restored.
+func (f *changefeed) reset(index uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.last = index
+	f.history = nil
+	f.next = 0
+	for ch := range f.subs {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// subscribe returns a channel receiving every change from index start on,
+// or from now on if start is 0. Buffered changes are sent first. It fails
+// if the change at start is no longer buffered. The channel is closed by
+// unsubscribe or when the subscriber falls behind.
+func (f *changefeed) subscribe(start uint64) (chan change, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var backlog []change
+	if start > 0 && start <= f.last {
+		buffered := f.buffered()
+		oldest := f.last + 1
+		if len(buffered) > 0 {
+			oldest = buffered[0].index
+		}
+		if start < oldest {
+			return nil, errFeedTooOld(start, oldest)
+		}
+		backlog = buffered[start-oldest:]
+	}
+	if f.subs == nil {
+		f.subs = make(map[chan change]uint64)
+	}
+	ch := make(chan change, feedBacklog+len(backlog))
+	for _, c := range backlog {
+		ch <- c
+	}
+	f.subs[ch] = start
+	return ch, nil
+}
+
+// buffered returns the buffered changes, oldest first. The caller must hold
+// f.mu.
+func (f *changefeed) buffered() []change {
+	if len(f.history) < feedHistory {
+		return f.history
+	}
+	return append(append([]change(nil), f.history[f.next:]...), f.history[:f.next]...)
+}
+
+// unsubscribe stops sending changes to ch and closes it.
+func (f *changefeed) unsubscribe(ch chan change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subs[ch]; ok {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// cmdChangefeed turns the connection into a subscriber to the node's
+// applied writes, from now on or from the given write index. It replies OK
+// and then sends each write, in commit order, as an array of its write
+// index and its arguments.
+func (kvm *Machine) cmdChangefeed(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	var start uint64
+	switch len(cmd.Args) {
+	case 1:
+	case 2:
+		var err error
+		start, err = strconv.ParseUint(string(cmd.Args[1]), 10, 64)
+		if err != nil || start == 0 {
+			return nil, errSyntaxError
+		}
+	default:
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	ch, err := kvm.feed.subscribe(start)
+	if err != nil {
+		return nil, err
+	}
+	ensureState(conn).detached = true
+	go kvm.serveFeed(conn.Detach(), ch)
+	return nil, nil
+}
+
+// serveFeed writes the changes received on ch to a detached subscriber
+// until it disconnects or falls behind.
+func (kvm *Machine) serveFeed(conn redcon.DetachedConn, ch chan change) {
+	defer conn.Close()
+	if nc := conn.NetConn(); nc != nil {
+		nc.SetReadDeadline(time.Time{})
+	}
+	go func() {
+		// Subscribers send nothing more, so any read ends the feed.
+		conn.ReadCommand()
+		kvm.feed.unsubscribe(ch)
+	}()
+
+	conn.WriteString("OK")
+	if err := kvm.flushDetached(conn); err != nil {
+		kvm.feed.unsubscribe(ch)
+		return
+	}
+	for c := range ch {
+		conn.WriteArray(len(c.args) + 1)
+		conn.WriteInt64(int64(c.index))
+		for _, arg := range c.args {
+			conn.WriteBulk(arg)
+		}
+		if err := kvm.flushDetached(conn); err != nil {
+			kvm.feed.unsubscribe(ch)
+			return
+		}
+	}
+}
+
+// flushDetached flushes the replies written to a detached connection,
+// within the write timeout.
+func (kvm *Machine) flushDetached(conn redcon.DetachedConn) error {
+	if nc := conn.NetConn(); nc != nil && kvm.opts.WriteTimeout > 0 {
+		nc.SetWriteDeadline(time.Now().Add(kvm.opts.WriteTimeout))
+	}
+	return conn.Flush()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/finn"
+)
+
+func TestChangefeed(t *testing.T) {
+	assert := assert.New(t)
+	join := func(args [][]byte) string {
+		return string(bytes.Join(args, []byte(" ")))
+	}
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	do(kvm, conn, "set", "before", "1")
+	ch, err := kvm.feed.subscribe(0)
+	assert.NoError(err)
+	do(kvm, conn, "set", "foo", "bar")
+	do(kvm, conn, "get", "foo")
+	do(kvm, conn, "incrbyfloat", "n", "1.5")
+	do(kvm, conn, "del", "foo")
+
+	var changes []change
+	for len(ch) > 0 {
+		changes = append(changes, <-ch)
+	}
+	if !assert.Len(changes, 3) {
+		return
+	}
+	assert.Equal(uint64(2), changes[0].index)
+	assert.Equal("set foo bar", join(changes[0].args))
+	assert.Equal(uint64(3), changes[1].index)
+	assert.Equal("SET n 1.5", join(changes[1].args))
+	assert.Equal(uint64(4), changes[2].index)
+	assert.Equal("del foo", join(changes[2].args))
+	assert.Equal(uint64(4), kvm.writeIndex())
+
+	kvm.feed.unsubscribe(ch)
+	_, ok := <-ch
+	assert.False(ok)
+}
+
+func TestChangefeedSlowSubscriber(t *testing.T) {
+	assert := assert.New(t)
+
+	var f changefeed
+	ch, err := f.subscribe(0)
+	assert.NoError(err)
+	for i := 0; i <= feedBacklog; i++ {
+		f.publish(uint64(i+1), [][]byte{[]byte("del"), []byte("foo")})
+	}
+	assert.Len(ch, feedBacklog)
+	for range ch {
+	}
+	assert.Len(f.subs, 0)
+	f.unsubscribe(ch)
+}
+
+func TestChangefeedStartIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	var f changefeed
+	publish := func(n int) {
+		for i := 0; i < n; i++ {
+			f.publish(f.last+1, [][]byte{[]byte("del"), []byte("foo")})
+		}
+	}
+	indexes := func(ch chan change) []uint64 {
+		var s []uint64
+		for len(ch) > 0 {
+			s = append(s, (<-ch).index)
+		}
+		return s
+	}
+
+	publish(3)
+	ch, err := f.subscribe(2)
+	assert.NoError(err)
+	publish(1)
+	assert.Equal([]uint64{2, 3, 4}, indexes(ch))
+	f.unsubscribe(ch)
+
+	// A start index ahead of the node waits for it.
+	ch, err = f.subscribe(6)
+	assert.NoError(err)
+	publish(2)
+	assert.Equal([]uint64{6}, indexes(ch))
+	f.unsubscribe(ch)
+
+	// Only the latest feedHistory changes are buffered.
+	publish(feedHistory)
+	oldest := f.last - feedHistory + 1
+	_, err = f.subscribe(oldest - 1)
+	assert.Equal(errFeedTooOld(oldest-1, oldest), err)
+	ch, err = f.subscribe(f.last - 1)
+	assert.NoError(err)
+	assert.Equal([]uint64{f.last - 1, f.last}, indexes(ch))
+
+	// Restoring a snapshot ends the subscriptions and empties the buffer.
+	f.reset(100000)
+	_, ok := <-ch
+	assert.False(ok)
+	_, err = f.subscribe(f.last - 1)
+	assert.Equal(errFeedTooOld(f.last-1, f.last+1), err)
+}
+
+func TestChangefeedCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+	do(kvm, conn, "set", "foo", "bar")
+
+	_, err := do(kvm, conn, "changefeed", "0")
+	assert.Equal(errSyntaxError, err)
+	_, err = do(kvm, conn, "changefeed", "x")
+	assert.Equal(errSyntaxError, err)
+	_, err = do(kvm, conn, "changefeed", "42", "43")
+	assert.Equal(finn.ErrWrongNumberOfArguments, err)
+
+	kvm.feed.reset(10)
+	replies, _ := do(kvm, conn, "changefeed", "5")
+	assert.Equal([]interface{}{"-" + errFeedTooOld(5, 11).Error()}, replies)
+	assert.Len(kvm.feed.subs, 0)
+}
+
+func TestWriteIndexSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	src, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+	do(src, conn, "set", "foo", "bar")
+	do(src, conn, "del", "foo", "missing")
+	do(src, conn, "set", "baz", "qux")
+	assert.Equal(uint64(3), src.writeIndex())
+
+	var buf bytes.Buffer
+	assert.NoError(src.Snapshot(&buf))
+
+	dst, cleanup := newTestMachine(t)
+	defer cleanup()
+	do(dst, conn, "set", "other", "1")
+	ch, err := dst.feed.subscribe(0)
+	assert.NoError(err)
+	assert.NoError(dst.Restore(bytes.NewReader(buf.Bytes())))
+
+	// The index continues from the snapshot's, and the record is not a key.
+	assert.Equal(uint64(3), dst.writeIndex())
+	_, ok := <-ch
+	assert.False(ok)
+	replies, _ := do(dst, conn, "keys", "*")
+	assert.Equal([]interface{}{[]int{1}, "baz"}, replies)
+	do(dst, conn, "set", "foo", "2")
+	assert.Equal(uint64(4), dst.writeIndex())
+
+	var cmds bytes.Buffer
+	assert.NoError(WriteRedisCommandsFromSnapshotReader(&cmds, bytes.NewReader(buf.Bytes())))
+	assert.Equal("*3\r\n$3\r\nSET\r\n$3\r\nbaz\r\n$3\r\nqux\r\n", cmds.String())
+}
+
+func TestReservedKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	for _, args := range [][]string{
+		{"set", indexRecordKey, "1"},
+		{"get", reservedPrefix + "x"},
+		{"del", "foo", reservedPrefix + "x"},
+		{"mget", "foo", reservedPrefix + "x"},
+		{"migrate", "127.0.0.1", "4921", "", "0", "100", "KEYS", reservedPrefix + "x"},
+		{"import", "*3\r\n$3\r\nSET\r\n$12\r\n\x00bitraft:abc\r\n$1\r\n1\r\n"},
+	} {
+		replies, _ := do(kvm, conn, args...)
+		assert.Equal([]interface{}{"-" + errReservedKey.Error()}, replies, args[0])
+	}
+
+	do(kvm, conn, "useprefix", "\x00bitraft:")
+	replies, _ := do(kvm, conn, "set", "x", "1")
+	assert.Equal([]interface{}{"-" + errReservedKey.Error()}, replies)
+}
+
+func TestChangefeedServe(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	addr, stop := serveTestMachine(t, kvm)
+	defer stop()
+	conn := &testConn{}
+	do(kvm, conn, "set", "a", "1")
+	do(kvm, conn, "set", "b", "2")
+
+	c, err := redis.Dial("tcp", addr, redis.DialReadTimeout(time.Second))
+	if !assert.NoError(err) {
+		return
+	}
+	defer c.Close()
+	reply, err := redis.String(c.Do("CHANGEFEED", "2"))
+	assert.NoError(err)
+	assert.Equal("OK", reply)
+
+	// The buffered change comes first, then the new ones.
+	do(kvm, conn, "del", "a")
+	for _, want := range []string{"2 set b 2", "3 del a"} {
+		values, err := redis.Values(c.Receive())
+		if !assert.NoError(err) {
+			return
+		}
+		got := fmt.Sprint(values[0])
+		for _, v := range values[1:] {
+			got += " " + string(v.([]byte))
+		}
+		assert.Equal(want, got)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+
+	"github.com/tidwall/redcon"
+)
+
+// compressMagic starts every bulk reply that was compressed for a
+// connection using CLIENT COMPRESS. The rest of the reply is a gzip
+// stream.
+var compressMagic = []byte("\x00BRZ")
+
+// compressConn gzips bulk replies of at least min bytes. Shorter replies
+// that happen to start with compressMagic are compressed too, so that a
+// client can tell compressed replies apart by their first bytes alone.
+type compressConn struct {
+	redcon.Conn
+	min int
+}
+
+func (c *compressConn) WriteBulk(bulk []byte) {
+	if len(bulk) < c.min && !bytes.HasPrefix(bulk, compressMagic) {
+		c.Conn.WriteBulk(bulk)
+		return
+	}
+	var buf bytes.Buffer
+	buf.Write(compressMagic)
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	zw.Write(bulk)
+	zw.Close()
+	c.Conn.WriteBulk(buf.Bytes())
+}
+
+func (c *compressConn) WriteBulkString(bulk string) {
+	c.WriteBulk([]byte(bulk))
+}
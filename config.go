@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var errDurabilityFixed = &respError{"ERR", "durability is fixed when the Raft log is opened and requires a restart"}
+
+// defaultLevel returns the consistency of reads without a CONSISTENCY
+// modifier.
+func (kvm *Machine) defaultLevel() finn.Level {
+	return finn.Level(atomic.LoadInt32(&kvm.readConsistency))
+}
+
+// configHelp describes the CONFIG subcommands for CONFIG HELP.
+var configHelp = []string{
+	"GET <pattern>",
+	"    Return the parameters matching <pattern> and their values.",
+	"SET <parameter> <value>",
+	"    Set a parameter on this node.",
+	"RESETSTAT",
+	"    Reset the statistics reported by INFO.",
+}
+
+// cmdConfig implements the CONFIG container command. Settings are local to
+// the node and are not replicated.
+func (kvm *Machine) cmdConfig(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	default:
+		return nil, errSyntaxError
+	case "help":
+		writeHelp(conn, "CONFIG", configHelp)
+		return nil, nil
+	case "get":
+		return kvm.cmdConfigGet(m, conn, cmd)
+	case "set":
+		return kvm.cmdConfigSet(m, conn, cmd)
+	case "resetstat":
+		return kvm.cmdConfigResetstat(m, conn, cmd)
+	}
+}
+
+// cmdConfigResetstat clears the statistics reported by INFO. The counters
+// are reset one after another, not as a single snapshot.
+func (kvm *Machine) cmdConfigResetstat(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	kvm.stats.reset()
+	atomic.StoreInt64(&kvm.hits, 0)
+	atomic.StoreInt64(&kvm.misses, 0)
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// cmdConfigGet replies with the name and value of the parameter, or of
+// every parameter for "*".
+func (kvm *Machine) cmdConfigGet(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	params := []string{
+		"consistency", levelName(kvm.defaultLevel()),
+		"durability", levelName(kvm.durability),
+	}
+	name := strings.ToLower(string(cmd.Args[2]))
+	var reply []string
+	for i := 0; i < len(params); i += 2 {
+		if name == "*" || name == params[i] {
+			reply = append(reply, params[i], params[i+1])
+		}
+	}
+	conn.WriteArray(len(reply))
+	for _, s := range reply {
+		conn.WriteBulk([]byte(s))
+	}
+	return nil, nil
+}
+
+// cmdConfigSet changes a parameter. Only the default read consistency can
+// change at runtime: finn fixes the durability when it opens the Raft log.
+// Reads stronger than the level finn was started with go through the Raft
+// log, as with the CONSISTENCY modifier.
+func (kvm *Machine) cmdConfigSet(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	switch strings.ToLower(string(cmd.Args[2])) {
+	default:
+		return nil, &respError{"ERR", "Unknown option '" + string(cmd.Args[2]) + "'"}
+	case "consistency":
+		level, ok := parseLevel(string(cmd.Args[3]))
+		if !ok {
+			return nil, errSyntaxError
+		}
+		atomic.StoreInt32(&kvm.readConsistency, int32(level))
+	case "durability":
+		return nil, errDurabilityFixed
+	}
+	conn.WriteString("OK")
+	return nil, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+func TestConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	replies, err := do(kvm, conn, "config", "set", "consistency", "high")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"+OK"}, replies)
+	assert.Equal(finn.High, kvm.defaultLevel())
+
+	replies, err = do(kvm, conn, "config", "get", "consistency")
+	assert.NoError(err)
+	assert.Equal([]interface{}{[]int{2}, "consistency", "high"}, replies)
+
+	replies, _ = do(kvm, conn, "config", "set", "durability", "high")
+	assert.Equal([]interface{}{"-" + errDurabilityFixed.Error()}, replies)
+
+	_, err = do(kvm, conn, "config", "set", "consistency", "bogus")
+	assert.Equal(errSyntaxError, err)
+}
+
+func TestConfigResetstat(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	do(kvm, conn, "echo", "foo")
+	replies, _ := do(kvm, conn, "info", "commandstats")
+	assert.Contains(replies[0], "cmdstat_echo:calls=1,")
+
+	replies, err := do(kvm, conn, "config", "resetstat")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"+OK"}, replies)
+	replies, _ = do(kvm, conn, "info", "commandstats")
+	assert.NotContains(replies[0], "cmdstat_echo")
+}
+
+func TestDurabilitySync(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	kvm.setDurability(finn.High)
+	replies, err := do(kvm, conn, "set", "foo", "bar")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"+OK"}, replies)
+	assert.Nil(kvm.syncDone)
+
+	kvm2, cleanup2 := newTestMachine(t)
+	defer cleanup2()
+	kvm2.setDurability(finn.Medium)
+	assert.NotNil(kvm2.syncDone)
+}
+
+// recordingApplier is a testApplier that records the commands it applies.
+type recordingApplier struct {
+	testApplier
+	applied []redcon.Command
+}
+
+func (a *recordingApplier) Apply(conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	a.applied = append(a.applied, cmd)
+	return a.testApplier.Apply(conn, cmd, mutate, respond)
+}
+
+func TestConsistencyReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	kvm.consistency = finn.Medium
+	conn := &testConn{}
+	do(kvm, conn, "set", "foo", "bar")
+	do(kvm, conn, "config", "set", "consistency", "high")
+
+	m := &recordingApplier{}
+	cmd := redcon.Command{Args: [][]byte{[]byte("get"), []byte("foo")}}
+	conn.replies = nil
+	_, err := kvm.Command(m, conn, cmd)
+	assert.NoError(err)
+	assert.Equal([]interface{}{"bar"}, conn.replies)
+	if !assert.Len(m.applied, 1) {
+		return
+	}
+	logged := m.applied[0]
+	assert.Equal("*4\r\n$3\r\nget\r\n$3\r\nfoo\r\n$11\r\nCONSISTENCY\r\n$4\r\nhigh\r\n", string(logged.Raw))
+
+	// Replaying the logged read on a node at another level does nothing.
+	do(kvm, conn, "config", "set", "consistency", "low")
+	for _, cmd := range []redcon.Command{cmd, logged} {
+		res, err := kvm.Command(m, nil, cmd)
+		assert.NoError(err)
+		assert.Nil(res)
+	}
+	assert.Len(m.applied, 1)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// connState is per-connection state. It lives in the redcon connection
+// context, so RESET clears all of it at once.
+type connState struct {
+	prefix   string // prepended to every key, set by USEPREFIX
+	readonly bool   // set by READONLY
+	noEvict  bool   // set by CLIENT NO-EVICT; bitraft never evicts clients
+	noTouch  bool   // set by CLIENT NO-TOUCH; bitraft keeps no access times
+	compress int    // minimum bulk reply size to compress, set by CLIENT COMPRESS
+	detached bool   // served outside of Command, set by CHANGEFEED and MONITOR
+}
+
+var errReadonlyConn = &respError{"READONLY", "You can't write against a read only replica."}
+
+// writeCommands are the commands refused on a READONLY connection.
+var writeCommands = map[string]bool{
+	"set":         true,
+	"del":         true,
+	"incrbyfloat": true,
+	"flushdb":     true,
+	"migrate":     true,
+	"import":      true,
+}
+
+// stateOf returns the state of conn, or nil if it has none. conn is nil
+// when finn replays a command from the Raft log.
+func stateOf(conn redcon.Conn) *connState {
+	if conn == nil {
+		return nil
+	}
+	st, _ := conn.Context().(*connState)
+	return st
+}
+
+// ensureState returns the state of conn, creating it if needed.
+func ensureState(conn redcon.Conn) *connState {
+	st := stateOf(conn)
+	if st == nil {
+		st = &connState{}
+		conn.SetContext(st)
+	}
+	return st
+}
+
+// buildCommand returns a command made of args, with Raw encoded to match
+// so that a rewritten command is replicated as rewritten.
+func buildCommand(args ...[]byte) redcon.Command {
+	return redcon.Command{
+		Raw:  appendCommand(nil, args),
+		Args: args,
+	}
+}
+
+// keyRange returns the positions of the first and last key arguments of
+// cmd, or last < first if it takes none. Commands taking keys must be
+// listed here for USEPREFIX to isolate them; KEYS filters on the prefix
+// itself. MIGRATE is handled separately.
+func keyRange(cmd redcon.Command) (first, last int) {
+	switch strings.ToLower(string(cmd.Args[0])) {
+	default:
+		return 0, -1
+	case "get", "localget", "set", "incrbyfloat":
+		return 1, 1
+	case "del":
+		return 1, len(cmd.Args) - 1
+	case "mget":
+		first, last = 1, len(cmd.Args)-1
+		if len(cmd.Args) > 3 && strings.ToLower(string(cmd.Args[last-1])) == "consistency" {
+			last -= 2
+		}
+		return first, last
+	case "object", "debug":
+		return 2, 2
+	}
+}
+
+// prefixKeys returns cmd with prefix prepended to each of its key
+// arguments.
+func prefixKeys(cmd redcon.Command, prefix string) redcon.Command {
+	if strings.ToLower(string(cmd.Args[0])) == "migrate" {
+		return prefixMigrate(cmd, prefix)
+	}
+	first, last := keyRange(cmd)
+	if last < first || len(cmd.Args) <= first {
+		return cmd
+	}
+	args := make([][]byte, len(cmd.Args))
+	copy(args, cmd.Args)
+	for i := first; i <= last; i++ {
+		args[i] = append([]byte(prefix), args[i]...)
+	}
+	return buildCommand(args...)
+}
+
+// prefixMigrate is prefixKeys for MIGRATE, whose keys are either its
+// fourth argument or, if that is empty, every argument after KEYS.
+func prefixMigrate(cmd redcon.Command, prefix string) redcon.Command {
+	if len(cmd.Args) < 4 {
+		return cmd
+	}
+	args := make([][]byte, len(cmd.Args))
+	copy(args, cmd.Args)
+	if len(args[3]) > 0 {
+		args[3] = append([]byte(prefix), args[3]...)
+	}
+	for i := 6; i < len(args); i++ {
+		if strings.ToLower(string(args[i])) == "keys" {
+			for j := i + 1; j < len(args); j++ {
+				args[j] = append([]byte(prefix), args[j]...)
+			}
+			break
+		}
+	}
+	return buildCommand(args...)
+}
+
+// cmdUseprefix binds the connection to a key prefix: keys in subsequent
+// commands are transparently prefixed and KEYS only sees keys under it.
+// An empty prefix removes the binding.
+func (kvm *Machine) cmdUseprefix(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	ensureState(conn).prefix = string(cmd.Args[1])
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// cmdReadonly makes the connection serve reads from the local node,
+// accepting stale data, whatever the consistency, and refuse writes.
+func (kvm *Machine) cmdReadonly(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	ensureState(conn).readonly = true
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// cmdReadwrite undoes READONLY.
+func (kvm *Machine) cmdReadwrite(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	ensureState(conn).readonly = false
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// clientHelp describes the CLIENT subcommands for CLIENT HELP.
+var clientHelp = []string{
+	"NO-EVICT (ON|OFF)",
+	"    Accepted for compatibility; bitraft never evicts clients.",
+	"NO-TOUCH (ON|OFF)",
+	"    Accepted for compatibility; bitraft keeps no access times.",
+	"COMPRESS (<min-size>|OFF)",
+	"    Gzip bulk replies of at least <min-size> bytes on this connection.",
+}
+
+// cmdClient implements the CLIENT container command. NO-EVICT and NO-TOUCH
+// are accepted for compatibility with clients that send them during their
+// handshake; bitraft neither evicts clients nor tracks key access, so the
+// flags are only recorded.
+func (kvm *Machine) cmdClient(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	switch sub := strings.ToLower(string(cmd.Args[1])); sub {
+	default:
+		return nil, &respError{"ERR", "unknown subcommand '" + string(cmd.Args[1]) + "'"}
+	case "help":
+		writeHelp(conn, "CLIENT", clientHelp)
+		return nil, nil
+	case "no-evict", "no-touch":
+		if len(cmd.Args) != 3 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		var on bool
+		switch strings.ToLower(string(cmd.Args[2])) {
+		default:
+			return nil, errSyntaxError
+		case "on":
+			on = true
+		case "off":
+		}
+		st := ensureState(conn)
+		if sub == "no-evict" {
+			st.noEvict = on
+		} else {
+			st.noTouch = on
+		}
+	case "compress":
+		if len(cmd.Args) != 3 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		var min int
+		if strings.ToLower(string(cmd.Args[2])) != "off" {
+			n, err := strconv.Atoi(string(cmd.Args[2]))
+			if err != nil || n <= 0 {
+				return nil, errSyntaxError
+			}
+			min = n
+		}
+		ensureState(conn).compress = min
+	}
+	conn.WriteString("OK")
+	return nil, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// diskCheckInterval is how often a node that ran out of disk space checks
+// whether space was recovered.
+const diskCheckInterval = time.Second * 10
+
+var errDiskFull = &respError{"ERR", "disk is full, writes are disabled until space is recovered"}
+
+// isDiskFull reports whether err is an out of space error. Bitcask wraps
+// its errors with github.com/pkg/errors, so the cause is checked.
+func isDiskFull(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	default:
+		err = e
+	}
+	return err == syscall.ENOSPC
+}
+
+// writeErr turns an out of space error from a write into errDiskFull,
+// putting the node in read-only mode. Other errors are returned as is.
+func (kvm *Machine) writeErr(err error) error {
+	if !isDiskFull(err) {
+		return err
+	}
+	if atomic.CompareAndSwapInt32(&kvm.diskFull, 0, 1) {
+		log.Warningf("disk is full, rejecting writes until space is recovered: %v", err)
+		go kvm.watchDiskSpace()
+	}
+	return errDiskFull
+}
+
+// watchDiskSpace clears the read-only mode once a file can be written to
+// the data directory again.
+func (kvm *Machine) watchDiskSpace() {
+	probe := make([]byte, 4096)
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		kvm.mu.RLock()
+		closed := kvm.closed
+		kvm.mu.RUnlock()
+		if closed {
+			return
+		}
+		f, err := ioutil.TempFile(kvm.dir, "diskcheck")
+		if err != nil {
+			continue
+		}
+		_, err = f.Write(probe)
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+		os.Remove(f.Name())
+		if err == nil {
+			log.Infof("disk space recovered, accepting writes")
+			atomic.StoreInt32(&kvm.diskFull, 0)
+			return
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskFull(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(isDiskFull(&os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}))
+	assert.False(isDiskFull(errors.New("other")))
+	assert.True(isDiskFull(pkgerrors.Wrap(&os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}, "error writing data")))
+	assert.True(isDiskFull(pkgerrors.Wrap(pkgerrors.Wrap(syscall.ENOSPC, "put"), "write")))
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+	do(kvm, conn, "set", "foo", "bar")
+
+	assert.Equal(errDiskFull, kvm.writeErr(syscall.ENOSPC))
+
+	replies, err := do(kvm, conn, "set", "foo", "baz")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"-" + errDiskFull.Error()}, replies)
+
+	replies, err = do(kvm, conn, "get", "foo")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"bar"}, replies)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/finn"
+)
+
+// dbSyncInterval is how often the database is synced at medium durability.
+const dbSyncInterval = time.Second
+
+// setDurability sets the durability level and makes Bitcask's syncing
+// match it: at high every write is synced before it is acknowledged, at
+// medium the database is synced every dbSyncInterval, and at low syncing
+// is left to the operating system.
+func (kvm *Machine) setDurability(level finn.Level) {
+	kvm.durability = level
+	if level == finn.Medium {
+		kvm.syncDone = make(chan struct{})
+		go kvm.syncLoop(kvm.syncDone)
+	}
+}
+
+// syncWrite syncs a write at high durability. The caller must hold kvm.mu
+// for writing.
+func (kvm *Machine) syncWrite() error {
+	if kvm.durability != finn.High {
+		return nil
+	}
+	return kvm.db.Sync()
+}
+
+func (kvm *Machine) syncLoop(done chan struct{}) {
+	t := time.NewTicker(dbSyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			kvm.mu.Lock()
+			if kvm.closed {
+				kvm.mu.Unlock()
+				return
+			}
+			if err := kvm.db.Sync(); err != nil {
+				log.Warningf("could not sync database: %v", kvm.writeErr(err))
+			}
+			kvm.mu.Unlock()
+		}
+	}
+}
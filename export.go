@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/prologic/bitcask"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// cmdExport replies with every key and value as an array of SET commands,
+// each itself an array, for clients copying a live node elsewhere without
+// access to its filesystem. MATCH restricts it to keys matching a glob
+// pattern.
+//
+// SINCE index makes the export incremental: it only has the keys written
+// after the write index, as SET commands, and those deleted since, as DEL
+// commands. The reply is then an array of the write index the export was
+// taken at, to pass as the next SINCE, and the array of commands. SINCE 0
+// exports every key.
+//
+// Like KEYS, it folds once to count the matching keys and again to stream
+// them, holding the read lock so both folds agree.
+func (kvm *Machine) cmdExport(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	args, level, err := kvm.readLevel(cmd.Args)
+	if err != nil {
+		return nil, err
+	}
+	pattern := "*"
+	var since uint64
+	var incremental bool
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		default:
+			return nil, errSyntaxError
+		case "match":
+			if i == len(args)-1 {
+				return nil, errSyntaxError
+			}
+			i++
+			pattern = string(args[i])
+		case "since":
+			if i == len(args)-1 {
+				return nil, errSyntaxError
+			}
+			i++
+			since, err = strconv.ParseUint(string(args[i]), 10, 64)
+			if err != nil {
+				return nil, errSyntaxError
+			}
+			incremental = true
+		}
+	}
+	release, err := kvm.beginScan(conn)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return kvm.applyRead(m, conn, cmd, level,
+		func(interface{}) (interface{}, error) {
+			ctx, cancel := kvm.commandContext()
+			defer cancel()
+			ctx, done := kvm.trackOp(ctx, "export")
+			defer done()
+			var prefix string
+			if st := stateOf(conn); st != nil {
+				prefix = st.prefix
+			}
+			matches := func(key string) bool {
+				return pattern == "*" || match.Match(key[len(prefix):], pattern)
+			}
+
+			kvm.mu.RLock()
+			defer kvm.mu.RUnlock()
+			if incremental {
+				conn.WriteArray(2)
+				conn.WriteInt64(int64(kvm.writeIndex()))
+			}
+			if since > 0 {
+				return nil, kvm.exportSince(ctx, conn, prefix, matches, since)
+			}
+			return nil, kvm.exportAll(ctx, conn, prefix, matches)
+		},
+	)
+}
+
+// exportAll writes the EXPORT reply of every matching key. The caller must
+// hold kvm.mu.
+func (kvm *Machine) exportAll(ctx context.Context, conn redcon.Conn, prefix string, matches func(key string) bool) error {
+	var count int
+	err := kvm.foldPrefix(ctx, prefix, func(key string) error {
+		if matches(key) {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	conn.WriteArray(count)
+	set := []byte("SET")
+	err = kvm.foldPrefix(ctx, prefix, func(key string) error {
+		if !matches(key) {
+			return nil
+		}
+		value, err := kvm.db.Get(key)
+		if err != nil {
+			return err
+		}
+		conn.WriteArray(3)
+		conn.WriteBulk(set)
+		conn.WriteBulk([]byte(key[len(prefix):]))
+		conn.WriteBulk(value)
+		return nil
+	})
+	if err != nil {
+		abortReply(conn, err)
+	}
+	return nil
+}
+
+// exportSince writes the EXPORT reply of the matching keys written after
+// write index since, from their records. The caller must hold kvm.mu.
+func (kvm *Machine) exportSince(ctx context.Context, conn redcon.Conn, prefix string, matches func(key string) bool, since uint64) error {
+	// foldSince calls fn for the matching keys written after since.
+	foldSince := func(fn func(key string, m keyMeta) error) error {
+		return kvm.db.Scan(metaPrefix+prefix, withContext(ctx, func(mkey string) error {
+			key := mkey[len(metaPrefix):]
+			if !matches(key) {
+				return nil
+			}
+			value, err := kvm.db.Get(mkey)
+			if err != nil {
+				return err
+			}
+			m, err := decodeMeta(value)
+			if err != nil {
+				return err
+			}
+			if m.index <= since {
+				return nil
+			}
+			return fn(key, m)
+		}))
+	}
+
+	var count int
+	err := foldSince(func(string, keyMeta) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	conn.WriteArray(count)
+	set, del := []byte("SET"), []byte("DEL")
+	err = foldSince(func(key string, m keyMeta) error {
+		var value []byte
+		if !m.deleted {
+			var err error
+			value, err = kvm.db.Get(key)
+			if err != nil && err != bitcask.ErrKeyNotFound {
+				return err
+			}
+			m.deleted = err == bitcask.ErrKeyNotFound
+		}
+		if m.deleted {
+			conn.WriteArray(2)
+			conn.WriteBulk(del)
+			conn.WriteBulk([]byte(key[len(prefix):]))
+			return nil
+		}
+		conn.WriteArray(3)
+		conn.WriteBulk(set)
+		conn.WriteBulk([]byte(key[len(prefix):]))
+		conn.WriteBulk(value)
+		return nil
+	})
+	if err != nil {
+		abortReply(conn, err)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExport(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	do(kvm, conn, "set", "user:1", "alice")
+	do(kvm, conn, "set", "order:1", "book")
+
+	replies, err := do(kvm, conn, "export", "match", "user:*")
+	assert.NoError(err)
+	assert.Equal([]interface{}{[]int{1}, []int{3}, "SET", "user:1", "alice"}, replies)
+
+	replies, err = do(kvm, conn, "export")
+	assert.NoError(err)
+	assert.Len(replies, 1+2*4)
+
+	_, err = do(kvm, conn, "export", "match")
+	assert.Equal(errSyntaxError, err)
+}
+
+// exportSince runs EXPORT SINCE since with the extra args and returns the
+// write index of the reply and its commands, each joined with spaces.
+func exportSince(kvm *Machine, conn *testConn, since string, args ...string) (int, []string, error) {
+	replies, err := do(kvm, conn, append([]string{"export", "since", since}, args...)...)
+	if err != nil || len(replies) < 3 {
+		return 0, nil, err
+	}
+	cmds := []string{}
+	for i := 3; i < len(replies); {
+		n := replies[i].([]int)[0]
+		var cmd []string
+		for _, arg := range replies[i+1 : i+1+n] {
+			cmd = append(cmd, arg.(string))
+		}
+		cmds = append(cmds, strings.Join(cmd, " "))
+		i += 1 + n
+	}
+	return replies[1].(int), cmds, nil
+}
+
+func TestExportSince(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	do(kvm, conn, "set", "a", "1")
+	do(kvm, conn, "set", "b", "2")
+
+	index, cmds, err := exportSince(kvm, conn, "0")
+	assert.NoError(err)
+	assert.Equal(2, index)
+	assert.ElementsMatch([]string{"SET a 1", "SET b 2"}, cmds)
+
+	// Only the writes after the baseline are exported, deletions as DEL.
+	do(kvm, conn, "set", "b", "3")
+	do(kvm, conn, "del", "a")
+	do(kvm, conn, "set", "c", "4")
+	index, cmds, err = exportSince(kvm, conn, "2")
+	assert.NoError(err)
+	assert.Equal(5, index)
+	assert.ElementsMatch([]string{"DEL a", "SET b 3", "SET c 4"}, cmds)
+
+	replies, err := do(kvm, conn, "export", "match", "c*", "since", "2")
+	assert.NoError(err)
+	assert.Equal([]interface{}{[]int{2}, 5, []int{1},
+		[]int{3}, "SET", "c", "4"}, replies)
+
+	replies, err = do(kvm, conn, "export", "since", "5")
+	assert.NoError(err)
+	assert.Equal([]interface{}{[]int{2}, 5, []int{0}}, replies)
+
+	// The records are not keys.
+	replies, _ = do(kvm, conn, "keys", "*", "sort")
+	assert.Equal([]interface{}{[]int{2}, "b", "c"}, replies)
+
+	_, err = do(kvm, conn, "export", "since", "-1")
+	assert.Equal(errSyntaxError, err)
+	_, err = do(kvm, conn, "export", "since")
+	assert.Equal(errSyntaxError, err)
+}
+
+func TestExportSincePrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	do(kvm, conn, "set", "t1:a", "1")
+	do(kvm, conn, "set", "t2:a", "2")
+	do(kvm, conn, "useprefix", "t1:")
+	do(kvm, conn, "del", "a")
+
+	replies, err := do(kvm, conn, "export", "since", "1")
+	assert.NoError(err)
+	assert.Equal([]interface{}{[]int{2}, 3, []int{1},
+		[]int{2}, "DEL", "a"}, replies)
+}
+
+func TestExportSinceSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	src, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+	do(src, conn, "set", "a", "1")
+	do(src, conn, "set", "b", "2")
+	do(src, conn, "del", "a")
+
+	var buf bytes.Buffer
+	assert.NoError(src.Snapshot(&buf))
+	dst, cleanup := newTestMachine(t)
+	defer cleanup()
+	assert.NoError(dst.Restore(bytes.NewReader(buf.Bytes())))
+
+	// The records, tombstones included, are replicated with the data.
+	index, cmds, err := exportSince(dst, conn, "1")
+	assert.NoError(err)
+	assert.Equal(3, index)
+	assert.ElementsMatch([]string{"DEL a", "SET b 2"}, cmds)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/prologic/bitcask"
+)
+
+// Fsck verifies the bitcask database in dir by reading back the value of
+// every key, writing any unreadable keys and a summary to w. It returns an
+// error if the database cannot be opened or any record is unreadable.
+// It refuses to run against a directory in use by a running node.
+//
+// bitcask has no read-only mode, so the database is opened from a view of
+// dir in a temporary directory: dir itself is never written to, and no
+// lock file is created in it.
+func Fsck(w io.Writer, dir string) error {
+	if err := checkUnlocked(dir); err != nil {
+		return err
+	}
+	view, err := viewDir(dir)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(view)
+
+	db, err := bitcask.Open(view)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var verified, unreadable int
+	err = db.Fold(func(key string) error {
+		if _, err := db.Get(key); err != nil {
+			fmt.Fprintf(w, "unreadable key %q: %v\n", key, err)
+			unreadable++
+			return nil
+		}
+		verified++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d keys verified, %d unreadable\n", verified, unreadable)
+	if unreadable > 0 {
+		return fmt.Errorf("%d unreadable records in %s", unreadable, dir)
+	}
+	return nil
+}
+
+// viewDir returns a new temporary directory holding the files of the
+// database in dir. Files are hard linked, which needs the directory to be
+// on the same file system as dir, and copied if that fails. Fsck only
+// reads, so the linked files are not modified, while anything bitcask
+// creates when opening the database goes into the view.
+func viewDir(dir string) (string, error) {
+	view, err := ioutil.TempDir(filepath.Dir(filepath.Clean(dir)), ".bitraft-fsck")
+	if err != nil {
+		if view, err = ioutil.TempDir("", "bitraft-fsck"); err != nil {
+			return "", err
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		os.RemoveAll(view)
+		return "", err
+	}
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() || fi.Name() == lockFilename || fi.Name() == flockFilename {
+			continue
+		}
+		src := filepath.Join(dir, fi.Name())
+		dst := filepath.Join(view, fi.Name())
+		if err := os.Link(src, dst); err != nil {
+			if err := copyFile(dst, src); err != nil {
+				os.RemoveAll(view)
+				return "", err
+			}
+		}
+	}
+	return view, nil
+}
+
+// copyFile copies the file at src to a new file at dst.
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prologic/bitcask"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsck(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "bitraft")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	db, err := bitcask.Open(dir)
+	assert.NoError(err)
+	assert.NoError(db.Put("foo", []byte("bar")))
+	assert.NoError(db.Put("hello", []byte("world")))
+	assert.NoError(db.Close())
+
+	var buf bytes.Buffer
+	assert.NoError(Fsck(&buf, dir))
+	assert.Equal("2 keys verified, 0 unreadable\n", buf.String())
+}
+
+func TestFsckReadOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "bitraft")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	db, err := bitcask.Open(dir)
+	assert.NoError(err)
+	assert.NoError(db.Put("foo", []byte("bar")))
+	assert.NoError(db.Close())
+	before, err := ioutil.ReadDir(dir)
+	assert.NoError(err)
+
+	// Fsck neither takes the lock nor leaves anything in the directory.
+	var buf bytes.Buffer
+	assert.NoError(Fsck(&buf, dir))
+	after, err := ioutil.ReadDir(dir)
+	assert.NoError(err)
+	assert.Equal(len(before), len(after))
+	_, err = os.Stat(filepath.Join(dir, lockFilename))
+	assert.True(os.IsNotExist(err))
+	views, err := filepath.Glob(filepath.Join(filepath.Dir(dir), ".bitraft-fsck*"))
+	assert.NoError(err)
+	assert.Len(views, 0)
+
+	// It still refuses a directory in use by a running node.
+	lock, err := acquireLock(dir)
+	assert.NoError(err)
+	defer lock.Release()
+	assert.Error(Fsck(&buf, dir))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// cmdGetpattern replies with alternating keys and values for every key
+// matching a glob pattern, read under a single lock so that the values
+// are consistent with each other. With COUNT it fails instead of
+// replying with more than count keys.
+func (kvm *Machine) cmdGetpattern(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	args, level, err := kvm.readLevel(cmd.Args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 2 && len(args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	pattern := string(args[1])
+	limit := -1
+	if len(args) == 4 {
+		if strings.ToLower(string(args[2])) != "count" {
+			return nil, errSyntaxError
+		}
+		limit, err = strconv.Atoi(string(args[3]))
+		if err != nil || limit < 0 {
+			return nil, errSyntaxError
+		}
+	}
+	release, err := kvm.beginScan(conn)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return kvm.applyRead(m, conn, cmd, level,
+		func(interface{}) (interface{}, error) {
+			ctx, cancel := kvm.commandContext()
+			defer cancel()
+			ctx, done := kvm.trackOp(ctx, "getpattern")
+			defer done()
+			var prefix string
+			if st := stateOf(conn); st != nil {
+				prefix = st.prefix
+			}
+			errTooMany := &respError{"ERR", "more than " + strconv.Itoa(limit) + " keys match"}
+
+			var pairs [][]byte
+			kvm.mu.RLock()
+			err := kvm.foldPrefix(ctx, prefix, func(key string) error {
+				if !match.Match(key[len(prefix):], pattern) {
+					return nil
+				}
+				if limit >= 0 && len(pairs)/2 == limit {
+					return errTooMany
+				}
+				value, err := kvm.db.Get(key)
+				if err != nil {
+					return err
+				}
+				pairs = append(pairs, []byte(key[len(prefix):]), value)
+				return nil
+			})
+			kvm.mu.RUnlock()
+			if err != nil {
+				return nil, err
+			}
+			conn.WriteArray(len(pairs))
+			for _, b := range pairs {
+				conn.WriteBulk(b)
+			}
+			return nil, nil
+		},
+	)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetpattern(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	do(kvm, conn, "set", "user:1", "alice")
+	do(kvm, conn, "set", "user:2", "bob")
+	do(kvm, conn, "set", "order:1", "book")
+
+	replies, err := do(kvm, conn, "getpattern", "order:*")
+	assert.NoError(err)
+	assert.Equal([]interface{}{[]int{2}, "order:1", "book"}, replies)
+
+	replies, err = do(kvm, conn, "getpattern", "user:*", "count", "2")
+	assert.NoError(err)
+	assert.Len(replies, 5)
+
+	replies, _ = do(kvm, conn, "getpattern", "user:*", "count", "1")
+	assert.Equal([]interface{}{"-ERR more than 1 keys match"}, replies)
+}
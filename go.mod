@@ -6,11 +6,13 @@ require (
 	github.com/coreos/etcd v3.3.12+incompatible // indirect
 	github.com/garyburd/redigo v1.0.0
 	github.com/golang/protobuf v1.3.1 // indirect
+	github.com/gofrs/flock v0.7.1
 	github.com/golang/snappy v0.0.0-20170215233205-553a64147049
 	github.com/hashicorp/go-msgpack v0.0.0-20150518234257-fa3f63826f7c
 	github.com/hashicorp/raft v0.0.0-20160824023112-5f09c4ffdbcd
 	github.com/kisielk/errcheck v1.2.0 // indirect
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
+	github.com/pkg/errors v0.8.1
 	github.com/prologic/bitcask v0.0.0-20190319214626-2d9bfbb408e1
 	github.com/sirupsen/logrus v1.4.0
 	github.com/spf13/afero v1.2.1 // indirect
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+)
+
+// serveHealth serves HTTP health checks for load balancers on addr.
+//
+// /healthz returns 200 while the machine is open and the local Raft node
+// answers RAFTSTATS in a state other than Shutdown. /ready returns 200 only
+// if, in addition, the cluster currently has a leader.
+func serveHealth(addr string, kvm *Machine) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := kvm.checkHealth(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK\n"))
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if err := kvm.checkHealth(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		leader, err := raftLeader(kvm.addr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if leader == "" {
+			http.Error(w, "no leader", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK\n"))
+	})
+	return http.ListenAndServe(addr, mux)
+}
+
+// checkHealth returns an error describing why the node is unhealthy, or nil.
+func (kvm *Machine) checkHealth() error {
+	kvm.mu.RLock()
+	closed := kvm.closed
+	kvm.mu.RUnlock()
+	if closed {
+		return errMachineClosed
+	}
+	stats, err := raftStats(kvm.addr)
+	if err != nil {
+		return err
+	}
+	if stats["state"] == "Shutdown" {
+		return errRaftShutdown
+	}
+	return nil
+}
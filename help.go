@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/tidwall/redcon"
+)
+
+// writeHelp replies to the HELP subcommand of a container command with
+// usage lines, laid out like Redis' own: a heading, then each subcommand
+// followed by an indented description.
+func writeHelp(conn redcon.Conn, name string, usage []string) {
+	lines := []string{name + " <subcommand> [<arg> [value] [opt] ...]. Subcommands are:"}
+	lines = append(lines, usage...)
+	lines = append(lines, "HELP", "    Print this help.")
+	conn.WriteArray(len(lines))
+	for _, line := range lines {
+		conn.WriteString(line)
+	}
+}
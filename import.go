@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var errInvalidImport = errors.New("invalid import stream")
+
+// parseCommands parses a stream of RESP commands, each an array of bulk
+// strings, as written by EXPORT clients and redis-cli --pipe.
+func parseCommands(data []byte) ([][][]byte, error) {
+	var cmds [][][]byte
+	for len(data) > 0 {
+		n, rest, err := parseRESPHeader(data, '*')
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+		args := make([][]byte, n)
+		for i := range args {
+			size, rest, err := parseRESPHeader(data, '$')
+			if err != nil {
+				return nil, err
+			}
+			if len(rest) < size+2 || rest[size] != '\r' || rest[size+1] != '\n' {
+				return nil, errInvalidImport
+			}
+			args[i] = rest[:size]
+			data = rest[size+2:]
+		}
+		cmds = append(cmds, args)
+	}
+	return cmds, nil
+}
+
+// parseRESPHeader parses a line made of typ and a number, which must be
+// positive for an array and may be zero for a bulk string.
+func parseRESPHeader(data []byte, typ byte) (int, []byte, error) {
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 2 || data[0] != typ {
+		return 0, nil, errInvalidImport
+	}
+	n, err := strconv.Atoi(string(data[1:end]))
+	if err != nil || n < 0 || (n == 0 && typ == '*') {
+		return 0, nil, errInvalidImport
+	}
+	return n, data[end+2:], nil
+}
+
+// validateImport checks that every command is a well formed SET or DEL of
+// keys that are not reserved.
+func validateImport(cmds [][][]byte) error {
+	for _, args := range cmds {
+		switch strings.ToLower(string(args[0])) {
+		default:
+			return &respError{"ERR", "IMPORT only accepts SET and DEL, got '" + string(args[0]) + "'"}
+		case "set":
+			if len(args) != 3 {
+				return finn.ErrWrongNumberOfArguments
+			}
+		case "del":
+			if len(args) < 2 {
+				return finn.ErrWrongNumberOfArguments
+			}
+		}
+		if hasReservedKey(redcon.Command{Args: args}) {
+			return errReservedKey
+		}
+	}
+	return nil
+}
+
+// cmdImport applies a stream of RESP SET and DEL commands, given as a
+// single argument, as one Raft entry, and replies with the number of
+// commands applied. It is a bulk load path: the whole stream is replicated
+// at once, so large loads should be split into several IMPORTs.
+func (kvm *Machine) cmdImport(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	cmds, err := parseCommands(cmd.Args[1])
+	if err != nil {
+		return nil, err
+	}
+	if err := validateImport(cmds); err != nil {
+		return nil, err
+	}
+	// Keys are prefixed before the stream is replicated, as connection
+	// state is not available when the log is replayed.
+	if st := stateOf(conn); st != nil && st.prefix != "" {
+		var payload []byte
+		for i, args := range cmds {
+			cmds[i] = prefixKeys(redcon.Command{Args: args}, st.prefix).Args
+			payload = appendCommand(payload, cmds[i])
+		}
+		cmd = buildCommand(cmd.Args[0], payload)
+	}
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			kvm.mu.Lock()
+			defer kvm.mu.Unlock()
+			var n int
+			for _, args := range cmds {
+				if strings.ToLower(string(args[0])) == "set" {
+					if err := kvm.db.Put(string(args[1]), args[2]); err != nil {
+						return n, kvm.writeErr(err)
+					}
+				} else {
+					for _, key := range args[1:] {
+						if err := kvm.db.Delete(string(key)); err != nil {
+							return n, kvm.writeErr(err)
+						}
+					}
+				}
+				kvm.recordWrite(args)
+				n++
+			}
+			if err := kvm.syncWrite(); err != nil {
+				return n, kvm.writeErr(err)
+			}
+			return n, nil
+		},
+		func(v interface{}) (interface{}, error) {
+			conn.WriteInt(v.(int))
+			return nil, nil
+		},
+	)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImport(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	do(kvm, conn, "set", "old", "x")
+	var payload []byte
+	payload = appendCommand(payload, [][]byte{[]byte("SET"), []byte("foo"), []byte("bar")})
+	payload = appendCommand(payload, [][]byte{[]byte("DEL"), []byte("old")})
+
+	replies, err := do(kvm, conn, "import", string(payload))
+	assert.NoError(err)
+	assert.Equal([]interface{}{2}, replies)
+	replies, _ = do(kvm, conn, "get", "foo")
+	assert.Equal([]interface{}{"bar"}, replies)
+	replies, _ = do(kvm, conn, "get", "old")
+	assert.Equal([]interface{}{nil}, replies)
+
+	payload = appendCommand(nil, [][]byte{[]byte("FLUSHDB")})
+	replies, _ = do(kvm, conn, "import", string(payload))
+	assert.Equal([]interface{}{"-ERR IMPORT only accepts SET and DEL, got 'FLUSHDB'"}, replies)
+
+	_, err = do(kvm, conn, "import", "*1\r\n$3\r\nSE")
+	assert.Equal(errInvalidImport, err)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/prologic/bitcask"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errNotFloat = &respError{"ERR", "value is not a valid float"}
+	errNaNOrInf = &respError{"ERR", "increment would produce NaN or Infinity"}
+)
+
+// parseFloat parses a float argument or value, refusing NaN and the
+// infinities like Redis does.
+func parseFloat(b []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+// cmdIncrbyfloat adds a float increment to the value of a key, a missing
+// key counting as 0, and replies with the new value. The value is stored
+// without an exponent or trailing zeros, as Redis formats it.
+func (kvm *Machine) cmdIncrbyfloat(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	incr, err := parseFloat(cmd.Args[2])
+	if err != nil {
+		return nil, err
+	}
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			kvm.mu.Lock()
+			defer kvm.mu.Unlock()
+			key := string(cmd.Args[1])
+			var f float64
+			value, err := kvm.db.Get(key)
+			if err == nil {
+				if f, err = parseFloat(value); err != nil {
+					return nil, err
+				}
+			} else if err != bitcask.ErrKeyNotFound {
+				return nil, err
+			}
+			f += incr
+			if math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, errNaNOrInf
+			}
+			value = []byte(strconv.FormatFloat(f, 'f', -1, 64))
+			if err := kvm.db.Put(key, value); err != nil {
+				return nil, kvm.writeErr(err)
+			}
+			if err := kvm.syncWrite(); err != nil {
+				return nil, kvm.writeErr(err)
+			}
+			// Record the result rather than the increment, so that
+			// replaying the file does not depend on float rounding.
+			kvm.recordWrite([][]byte{[]byte("SET"), cmd.Args[1], value})
+			return value, nil
+		},
+		func(v interface{}) (interface{}, error) {
+			conn.WriteBulk(v.([]byte))
+			return nil, nil
+		},
+	)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync/atomic"
+
+	"github.com/tidwall/redcon"
+)
+
+// reservedPrefix starts the keys bitraft keeps for itself. Clients cannot
+// name them and scans skip them.
+const reservedPrefix = "\x00bitraft:"
+
+// indexRecordKey is the key of the snapshot record holding the write index
+// the snapshot was taken at. It is never stored in the database.
+const indexRecordKey = reservedPrefix + "index"
+
+var errReservedKey = &respError{"ERR", "keys starting with \\x00bitraft: are reserved"}
+
+// isReserved reports whether key is one of bitraft's own.
+func isReserved(key string) bool {
+	return strings.HasPrefix(key, reservedPrefix)
+}
+
+// hasReservedKey reports whether cmd names a reserved key. The arguments
+// of MIGRATE after its key are options or keys, so they are all checked.
+func hasReservedKey(cmd redcon.Command) bool {
+	first, last := keyRange(cmd)
+	if strings.ToLower(string(cmd.Args[0])) == "migrate" {
+		first, last = 3, len(cmd.Args)-1
+	}
+	for i := first; i <= last && i < len(cmd.Args); i++ {
+		if isReserved(string(cmd.Args[i])) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeIndex returns the snapshot record value of a write index.
+func encodeIndex(index uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, index)
+	return b
+}
+
+// decodeIndex parses the snapshot record value of a write index.
+func decodeIndex(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, errors.New("invalid write index record")
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// writeIndex returns the index of the last write applied.
+func (kvm *Machine) writeIndex() uint64 {
+	return atomic.LoadUint64(&kvm.index)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// infoSections are the sections INFO returns when none is named, in order.
+// Expensive sections are only returned when named explicitly.
+var infoSections = []string{"server", "stats", "commandstats"}
+
+// valueSizeBuckets are the upper bounds, in bytes, of the buckets of the
+// values-histogram INFO section. Larger values fall in a final bucket.
+var valueSizeBuckets = []int{64, 1 << 10, 16 << 10}
+
+// cmdInfo replies with information about the node in the Redis INFO
+// format. Sections may be named as arguments; "all" is every section that
+// is cheap to compute.
+func (kvm *Machine) cmdInfo(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	var sections []string
+	for _, arg := range cmd.Args[1:] {
+		switch name := strings.ToLower(string(arg)); name {
+		case "all", "default":
+			sections = append(sections, infoSections...)
+		default:
+			sections = append(sections, name)
+		}
+	}
+	if len(sections) == 0 {
+		sections = infoSections
+	}
+
+	var buf bytes.Buffer
+	for _, section := range sections {
+		switch section {
+		case "server":
+			kvm.infoServer(&buf)
+		case "stats":
+			kvm.infoStats(&buf)
+		case "commandstats":
+			kvm.stats.writeInfo(&buf)
+		case "values-histogram":
+			if err := kvm.infoValuesHistogram(conn, &buf); err != nil {
+				return nil, err
+			}
+		default:
+			// Unknown sections are ignored, as in Redis.
+			continue
+		}
+		buf.WriteString("\r\n")
+	}
+	conn.WriteBulk(buf.Bytes())
+	return nil, nil
+}
+
+func (kvm *Machine) infoServer(buf *bytes.Buffer) {
+	buf.WriteString("# Server\r\n")
+	fmt.Fprintf(buf, "bitraft_version:%s\r\n", FullVersion())
+	fmt.Fprintf(buf, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(buf, "tcp_addr:%s\r\n", kvm.addr)
+	fmt.Fprintf(buf, "uptime_in_seconds:%d\r\n", int64(time.Since(kvm.started)/time.Second))
+}
+
+// infoStats reports the node-local keyspace hits and misses of GET and
+// LOCALGET, and the write index of the last applied write.
+func (kvm *Machine) infoStats(buf *bytes.Buffer) {
+	buf.WriteString("# Stats\r\n")
+	fmt.Fprintf(buf, "keyspace_hits:%d\r\n", atomic.LoadInt64(&kvm.hits))
+	fmt.Fprintf(buf, "keyspace_misses:%d\r\n", atomic.LoadInt64(&kvm.misses))
+	fmt.Fprintf(buf, "write_index:%d\r\n", kvm.writeIndex())
+}
+
+// infoValuesHistogram counts values by size. It reads every value, so it
+// only runs when asked for, and counts as a scan towards
+// MaxConcurrentScans.
+func (kvm *Machine) infoValuesHistogram(conn redcon.Conn, buf *bytes.Buffer) error {
+	release, err := kvm.beginScan(conn)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx, cancel := kvm.commandContext()
+	defer cancel()
+	ctx, done := kvm.trackOp(ctx, "info values-histogram")
+	defer done()
+
+	counts := make([]int, len(valueSizeBuckets)+1)
+	kvm.mu.RLock()
+	err = kvm.fold(ctx, func(key string) error {
+		value, err := kvm.db.Get(key)
+		if err != nil {
+			return err
+		}
+		i := 0
+		for i < len(valueSizeBuckets) && len(value) >= valueSizeBuckets[i] {
+			i++
+		}
+		counts[i]++
+		return nil
+	})
+	kvm.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	buf.WriteString("# Values-histogram\r\n")
+	lower := 0
+	for i, upper := range valueSizeBuckets {
+		fmt.Fprintf(buf, "values_%s_%s:%d\r\n", sizeName(lower), sizeName(upper), counts[i])
+		lower = upper
+	}
+	fmt.Fprintf(buf, "values_%s_inf:%d\r\n", sizeName(lower), counts[len(valueSizeBuckets)])
+	return nil
+}
+
+// sizeName formats a size in bytes compactly, e.g. 64, 1k or 16k.
+func sizeName(n int) string {
+	if n >= 1<<10 && n%(1<<10) == 0 {
+		return fmt.Sprintf("%dk", n>>10)
+	}
+	return fmt.Sprintf("%d", n)
+}
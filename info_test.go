@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInfoValuesHistogram(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	do(kvm, conn, "set", "small", "x")
+	do(kvm, conn, "set", "medium", strings.Repeat("x", 64))
+	do(kvm, conn, "set", "large", strings.Repeat("x", 16<<10))
+
+	replies, err := do(kvm, conn, "info")
+	assert.NoError(err)
+	assert.Contains(replies[0], "# Server\r\n")
+	assert.NotContains(replies[0], "# Values-histogram")
+
+	replies, err = do(kvm, conn, "info", "values-histogram")
+	assert.NoError(err)
+	assert.Equal("# Values-histogram\r\n"+
+		"values_0_64:1\r\n"+
+		"values_64_1k:1\r\n"+
+		"values_1k_16k:0\r\n"+
+		"values_16k_inf:1\r\n\r\n", replies[0])
+}
+
+func TestInfoStats(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	do(kvm, conn, "set", "foo", "bar")
+	do(kvm, conn, "get", "foo")
+	do(kvm, conn, "get", "foo")
+	do(kvm, conn, "localget", "missing")
+
+	replies, err := do(kvm, conn, "info", "stats")
+	assert.NoError(err)
+	assert.Equal("# Stats\r\nkeyspace_hits:2\r\nkeyspace_misses:1\r\nwrite_index:1\r\n\r\n", replies[0])
+}
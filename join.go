@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// splitJoin splits a comma separated --join value into addresses.
+func splitJoin(join string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(join, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// pickJoinAddr returns the first of addrs whose node answers, asking each
+// for its leader. If none answers it returns an empty string.
+func pickJoinAddr(addrs []string) string {
+	for _, addr := range addrs {
+		log.Infof("trying to join via %s", addr)
+		if _, err := raftLeader(addr); err != nil {
+			log.Warningf("join address %s unavailable: %v", addr, err)
+			continue
+		}
+		return addr
+	}
+	return ""
+}
+
+// maxJoinRetryInterval caps the backoff between join attempts.
+const maxJoinRetryInterval = time.Minute
+
+// waitJoinAddr is pickJoinAddr retried up to retries more times, doubling
+// the wait between attempts from interval, for clusters whose nodes are
+// all restarting.
+func waitJoinAddr(addrs []string, retries int, interval time.Duration) string {
+	for attempt := 0; ; attempt++ {
+		if addr := pickJoinAddr(addrs); addr != "" {
+			return addr
+		}
+		if attempt >= retries {
+			return ""
+		}
+		log.Warningf("no join address is reachable, retrying in %s (%d/%d)", interval, attempt+1, retries)
+		time.Sleep(interval)
+		if interval *= 2; interval > maxJoinRetryInterval {
+			interval = maxJoinRetryInterval
+		}
+	}
+}
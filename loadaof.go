@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readCommand reads one RESP command, an array of bulk strings, from br.
+// It returns io.EOF if br is exhausted before the command starts.
+func readCommand(br *bufio.Reader) ([][]byte, error) {
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	n, _, err := parseRESPHeader(line, '*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([][]byte, n)
+	for i := range args {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		size, _, err := parseRESPHeader(line, '$')
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(br, arg); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, errInvalidImport
+		}
+		args[i] = arg[:size]
+	}
+	return args, nil
+}
+
+// raftStateFiles are the files finn keeps in the Raft log directory: the
+// log, the snapshots and the peers.
+var raftStateFiles = []string{"raft.db", "snapshots", peersFilename}
+
+// hasRaftState reports whether logdir holds Raft state.
+func hasRaftState(logdir string) (bool, error) {
+	for _, name := range raftStateFiles {
+		_, err := os.Stat(filepath.Join(logdir, name))
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// LoadAOF populates the database in dir from a stream of RESP SET and DEL
+// commands read from path ("-" reads stdin), such as the output of
+// --parse-snapshot or an append-only file, without going through Raft.
+// It writes the number of commands loaded to w. Commands before a
+// malformed or unsupported one are kept.
+//
+// The loaded keys are not in the Raft log, so it refuses to load into a
+// node whose log directory, logdir, already holds Raft state: its keys
+// would silently diverge from those of the other nodes.
+func LoadAOF(w io.Writer, dir, logdir, path string, opts *Options) error {
+	if ok, err := hasRaftState(logdir); err != nil {
+		return err
+	} else if ok {
+		return fmt.Errorf("%q holds Raft state: --load-aof only seeds nodes that have never been started", logdir)
+	}
+	rd := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rd = f
+	}
+
+	// The loaded commands must not be recorded again.
+	o := *opts
+	o.AppendOnly = false
+	kvm, err := NewMachine(dir, "", &o)
+	if err != nil {
+		return err
+	}
+	defer kvm.Close()
+
+	br := bufio.NewReader(rd)
+	var n int
+	for ; ; n++ {
+		args, err := readCommand(br)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = kvm.loadCommand(args)
+		}
+		if err != nil {
+			fmt.Fprintf(w, "%d commands loaded\n", n)
+			return fmt.Errorf("command %d: %v", n+1, err)
+		}
+	}
+	if err := kvm.db.Sync(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d commands loaded\n", n)
+	return nil
+}
+
+// loadCommand applies a SET or DEL command read by LoadAOF.
+func (kvm *Machine) loadCommand(args [][]byte) error {
+	switch strings.ToLower(string(args[0])) {
+	default:
+		return fmt.Errorf("unsupported command '%s'", args[0])
+	case "set":
+		if len(args) != 3 {
+			return fmt.Errorf("wrong number of arguments for '%s'", args[0])
+		}
+		return kvm.db.Put(string(args[1]), args[2])
+	case "del":
+		if len(args) < 2 {
+			return fmt.Errorf("wrong number of arguments for '%s'", args[0])
+		}
+		for _, key := range args[1:] {
+			if err := kvm.db.Delete(string(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
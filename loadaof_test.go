@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadAOF(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "bitraft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var stream []byte
+	stream = appendCommand(stream, [][]byte{[]byte("SET"), []byte("foo"), []byte("1")})
+	stream = appendCommand(stream, [][]byte{[]byte("set"), []byte("bar"), []byte("")})
+	stream = appendCommand(stream, [][]byte{[]byte("DEL"), []byte("foo")})
+	path := filepath.Join(dir, "load.aof")
+	assert.NoError(ioutil.WriteFile(path, stream, 0644))
+
+	data := filepath.Join(dir, "data")
+	var out bytes.Buffer
+	assert.NoError(LoadAOF(&out, data, data, path, &Options{}))
+	assert.Equal("3 commands loaded\n", out.String())
+
+	kvm, err := NewMachine(data, "127.0.0.1:4920", nil)
+	if !assert.NoError(err) {
+		return
+	}
+	conn := &testConn{}
+	replies, _ := do(kvm, conn, "mget", "foo", "bar")
+	assert.Equal([]interface{}{[]int{2}, nil, ""}, replies)
+	kvm.Close()
+
+	stream = appendCommand(stream, [][]byte{[]byte("FLUSHDB")})
+	assert.NoError(ioutil.WriteFile(path, stream, 0644))
+	out.Reset()
+	assert.Error(LoadAOF(&out, data, data, path, &Options{}))
+	assert.Equal("3 commands loaded\n", out.String())
+
+	assert.NoError(ioutil.WriteFile(path, stream[:len(stream)-3], 0644))
+	assert.Error(LoadAOF(&out, data, data, path, &Options{}))
+
+	// A node that has been started has Raft state, and its loaded keys
+	// would diverge from the other nodes'.
+	for _, name := range raftStateFiles {
+		t.Run(name, func(t *testing.T) {
+			logdir := filepath.Join(dir, "log-"+name)
+			assert.NoError(os.MkdirAll(logdir, 0755))
+			assert.NoError(ioutil.WriteFile(filepath.Join(logdir, name), nil, 0644))
+			out.Reset()
+			err := LoadAOF(&out, data, logdir, path, &Options{})
+			assert.EqualError(err, `"`+logdir+`" holds Raft state: --load-aof only seeds nodes that have never been started`)
+			assert.Equal("", out.String())
+		})
+	}
+}
+
+func TestLoadAOFFromSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	src, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+	do(src, conn, "set", "key1", "1")
+	do(src, conn, "set", "kfoo", "2")
+	do(src, conn, "set", "empty", "")
+
+	var snap, cmds bytes.Buffer
+	assert.NoError(src.Snapshot(&snap))
+	assert.NoError(WriteRedisCommandsFromSnapshotReader(&cmds, &snap))
+
+	dir, err := ioutil.TempDir("", "bitraft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dump.aof")
+	assert.NoError(ioutil.WriteFile(path, cmds.Bytes(), 0644))
+
+	data := filepath.Join(dir, "data")
+	var out bytes.Buffer
+	assert.NoError(LoadAOF(&out, data, data, path, &Options{}))
+	assert.Equal("3 commands loaded\n", out.String())
+
+	dst, err := NewMachine(data, "127.0.0.1:4920", nil)
+	if !assert.NoError(err) {
+		return
+	}
+	defer dst.Close()
+	replies, _ := do(dst, conn, "mget", "key1", "kfoo", "empty", "ey1", "foo")
+	assert.Equal([]interface{}{[]int{5}, "1", "2", "", nil, nil}, replies)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/flock"
+)
+
+// lockFilename is the name of the pid file naming the process serving the
+// data directory. It is informational: flockFilename is what guards the
+// directory.
+const lockFilename = "bitraft.pid"
+
+// flockFilename is the name of the file holding the advisory lock on the
+// data directory. It is never removed: removing a locked file would let a
+// process that opened it beforehand and one that creates it afresh both
+// lock it.
+const flockFilename = "bitraft.lock"
+
+// lockFile is an advisory lock stopping two processes from serving the same
+// data directory at once. The operating system releases it when the
+// process exits, so a crash never leaves a stale lock behind.
+type lockFile struct {
+	flock   *flock.Flock
+	pidPath string
+}
+
+// acquireLock locks the data directory in dir and writes our pid to the pid
+// file. It fails if another process, or another Machine in this process,
+// holds the lock.
+func acquireLock(dir string) (*lockFile, error) {
+	fl := flock.New(filepath.Join(dir, flockFilename))
+	ok, err := fl.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errDirInUse(dir)
+	}
+	l := &lockFile{flock: fl, pidPath: filepath.Join(dir, lockFilename)}
+	if err := writePidFile(l.pidPath); err != nil {
+		fl.Unlock()
+		return nil, err
+	}
+	return l, nil
+}
+
+// writePidFile writes our pid to path under a temporary name and renames it
+// into place, so that it is never seen empty.
+func writePidFile(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), lockFilename+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(tmp, "%d\n", os.Getpid())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// errDirInUse describes the data directory in dir being locked, naming the
+// holder from the pid file if it can be read.
+func errDirInUse(dir string) error {
+	data, _ := ioutil.ReadFile(filepath.Join(dir, lockFilename))
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+		return fmt.Errorf("data directory %q is in use by process %d", dir, pid)
+	}
+	return fmt.Errorf("data directory %q is in use by another process", dir)
+}
+
+// checkUnlocked fails if another process holds the lock on dir. It is for
+// tools that only read the data directory and so must not take the lock
+// or create any file.
+func checkUnlocked(dir string) error {
+	path := filepath.Join(dir, flockFilename)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	fl := flock.New(path)
+	ok, err := fl.TryLock()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errDirInUse(dir)
+	}
+	return fl.Unlock()
+}
+
+// Release removes the pid file and unlocks the data directory.
+func (l *lockFile) Release() error {
+	err := os.Remove(l.pidPath)
+	if uerr := l.flock.Unlock(); err == nil {
+		err = uerr
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcquireLock(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "bitraft")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	t.Run("Live", func(t *testing.T) {
+		lock, err := acquireLock(dir)
+		assert.NoError(err)
+
+		_, err = acquireLock(dir)
+		assert.EqualError(err, `data directory "`+dir+`" is in use by process `+strconv.Itoa(os.Getpid()))
+
+		assert.NoError(lock.Release())
+	})
+
+	t.Run("Stale", func(t *testing.T) {
+		// A pid file left by a crash does not matter: its lock went with
+		// the process.
+		path := filepath.Join(dir, lockFilename)
+		assert.NoError(ioutil.WriteFile(path, []byte("999999999\n"), 0644))
+
+		lock, err := acquireLock(dir)
+		assert.NoError(err)
+		assert.NoError(lock.Release())
+	})
+
+	t.Run("OwnPid", func(t *testing.T) {
+		path := filepath.Join(dir, lockFilename)
+		pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+		assert.NoError(ioutil.WriteFile(path, pid, 0644))
+
+		lock, err := acquireLock(dir)
+		assert.NoError(err)
+		data, _ := ioutil.ReadFile(path)
+		assert.Equal(pid, data)
+		assert.NoError(lock.Release())
+
+		_, err = os.Stat(path)
+		assert.True(os.IsNotExist(err))
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		const n = 16
+		locks := make(chan *lockFile, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if lock, err := acquireLock(dir); err == nil {
+					locks <- lock
+				}
+			}()
+		}
+		wg.Wait()
+		close(locks)
+		assert.Len(locks, 1)
+		for lock := range locks {
+			assert.NoError(lock.Release())
+		}
+	})
+}
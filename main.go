@@ -3,25 +3,45 @@ package main
 import (
 	"fmt"
 	"os"
-	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
-	"github.com/tidwall/finn"
 )
 
 var (
 	debug           bool
 	version         bool
+	fsck            bool
+	noCreateDirs    bool
+	keysSingleFold  bool
+	maxScans        int
+	acceptRateLimit int
+	protectedMode   bool
+	logUnknownCmds  bool
+	joinRetries     int
+	joinRetryIntvl  time.Duration
+	appendOnly      bool
+	appendFsync     string
+	aofRotateSize   int64
 	maxDatafileSize int
+	snapshotBufSize int
+	snapshotGzip    bool
+	snapshotVarint  bool
+	commandTimeout  time.Duration
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	waitLeader      time.Duration
 
 	bind          string
+	healthAddr    string
 	dir           string
 	logdir        string
 	join          string
 	consistency   string
 	durability    string
 	parseSnapshot string
+	loadAOF       string
 )
 
 func init() {
@@ -32,16 +52,38 @@ func init() {
 
 	flag.BoolVarP(&version, "version", "V", false, "display version information")
 	flag.BoolVarP(&debug, "debug", "D", false, "enable debug logging")
+	flag.BoolVar(&logUnknownCmds, "log-unknown-commands", false, "log unknown commands as warnings instead of at debug level")
+	flag.BoolVar(&fsck, "fsck", false, "verify every record in the data directory and exit")
 
 	flag.IntVar(&maxDatafileSize, "max-datafile-size", 1<<20, "maximum datafile size in bytes")
+	flag.BoolVar(&snapshotGzip, "snapshot-gzip", true, "gzip compress snapshots")
+	flag.BoolVar(&snapshotVarint, "snapshot-varint", false, "write snapshot lengths as varints (smaller, unreadable by older versions)")
+	flag.IntVar(&snapshotBufSize, "snapshot-buffer-size", defaultSnapshotBufferSize, "snapshot write buffer size in bytes")
+	flag.DurationVar(&commandTimeout, "command-timeout", 0, "maximum duration of a single command (0 disables)")
+	flag.DurationVar(&readTimeout, "read-timeout", 0, "maximum time for a client to send its next command (0 disables)")
+	flag.DurationVar(&writeTimeout, "write-timeout", 0, "maximum time to write a reply to a client (0 disables)")
+	flag.DurationVar(&waitLeader, "wait-for-leader-timeout", 0, "maximum time a command waits for a leader to be elected before failing (0 fails immediately)")
+	flag.BoolVar(&appendOnly, "appendonly", false, "record applied writes in an append-only file in the data directory")
+	flag.StringVar(&appendFsync, "aof-fsync", "everysec", "append-only file fsync policy (always,everysec,no)")
+	flag.Int64Var(&aofRotateSize, "aof-rotate-size", 64<<20, "rotate the append-only file at this size in bytes (0 disables)")
+	flag.IntVar(&maxScans, "max-concurrent-scans", 0, "maximum KEYS, GETPATTERN, EXPORT and INFO values-histogram commands served at once, more are refused with BUSY (0 disables)")
+	flag.BoolVar(&keysSingleFold, "keys-single-fold", false, "buffer KEYS replies in a single pass (faster on small keyspaces, uses more memory)")
+
+	flag.BoolVar(&protectedMode, "protected-mode", true, "refuse commands from non-loopback clients")
+	flag.IntVar(&acceptRateLimit, "accept-rate-limit", 0, "maximum new connections per second, excess connections are refused (0 disables)")
 
 	flag.StringVarP(&bind, "bind", "b", "127.0.0.1:4920", "bind/discoverable ip:port")
+	flag.StringVar(&healthAddr, "health-addr", "", "serve HTTP /healthz and /ready checks on this ip:port")
 	flag.StringVarP(&dir, "data", "d", "data", "data directory")
 	flag.StringVarP(&logdir, "log-dir", "l", "", "log directory. If blank it will equals --data")
-	flag.StringVarP(&join, "join", "j", "", "Join a cluster by providing an address")
+	flag.BoolVar(&noCreateDirs, "no-create-dirs", false, "fail if the data or log directory does not exist instead of creating it")
+	flag.StringVarP(&join, "join", "j", "", "Join a cluster by providing an address, or a comma separated list of addresses to try in turn")
+	flag.IntVar(&joinRetries, "join-retries", 0, "retry joining this many times when no join address is reachable")
+	flag.DurationVar(&joinRetryIntvl, "join-retry-interval", time.Second, "wait before the first join retry, doubled for each retry")
 	flag.StringVar(&consistency, "consistency", "low", "Consistency (low,medium,high)")
 	flag.StringVar(&durability, "durability", "low", "Durability (low,medium,high)")
-	flag.StringVar(&parseSnapshot, "parse-snapshot", "", "Parse and output a snapshot to Redis format")
+	flag.StringVar(&parseSnapshot, "parse-snapshot", "", "Parse and output a snapshot to Redis format (- reads stdin)")
+	flag.StringVar(&loadAOF, "load-aof", "", "load SET and DEL commands in Redis format into the data directory and exit (- reads stdin)")
 }
 
 func main() {
@@ -67,35 +109,85 @@ func main() {
 		return
 	}
 
-	var lconsistency finn.Level
-	switch strings.ToLower(consistency) {
-	default:
+	if fsck {
+		if err := Fsck(os.Stdout, dir); err != nil {
+			log.Warningf("%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if loadAOF != "" {
+		opts := Options{
+			MaxDatafileSize: maxDatafileSize,
+			NoCreateDirs:    noCreateDirs,
+		}
+		ldir := logdir
+		if ldir == "" {
+			ldir = dir
+		}
+		if err := LoadAOF(os.Stdout, dir, ldir, loadAOF, &opts); err != nil {
+			log.Warningf("%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	bindAddr, err := validateAddr(bind)
+	if err != nil {
+		log.Warningf("invalid --bind %q: %v", bind, err)
+		os.Exit(1)
+	}
+	for _, addr := range splitJoin(join) {
+		joinAddr, err := validateAddr(addr)
+		if err != nil {
+			log.Warningf("invalid --join %q: %v", addr, err)
+			os.Exit(1)
+		}
+		if joinAddr.String() == bindAddr.String() {
+			log.Warningf("--join %q must be the address of another node, not this one", addr)
+			os.Exit(1)
+		}
+	}
+
+	lconsistency, ok := parseLevel(consistency)
+	if !ok {
 		log.Warningf("invalid --consistency")
-	case "low":
-		lconsistency = finn.Low
-	case "medium", "med":
-		lconsistency = finn.Medium
-	case "high":
-		lconsistency = finn.High
 	}
 
-	var ldurability finn.Level
-	switch strings.ToLower(durability) {
-	default:
+	ldurability, ok := parseLevel(durability)
+	if !ok {
 		log.Warningf("invalid --durability")
-	case "low":
-		ldurability = finn.Low
-	case "medium", "med":
-		ldurability = finn.Medium
-	case "high":
-		ldurability = finn.High
 	}
 
 	if logdir == "" {
 		logdir = dir
 	}
 
-	if err := ListenAndServe(bind, join, dir, logdir, lconsistency, ldurability); err != nil {
+	opts := Options{
+		CommandTimeout:       commandTimeout,
+		MaxDatafileSize:      maxDatafileSize,
+		SnapshotBufferSize:   snapshotBufSize,
+		DisableSnapshotGzip:  !snapshotGzip,
+		SnapshotVarint:       snapshotVarint,
+		NoCreateDirs:         noCreateDirs,
+		HealthAddr:           healthAddr,
+		ReadTimeout:          readTimeout,
+		WriteTimeout:         writeTimeout,
+		WaitForLeaderTimeout: waitLeader,
+		KeysSingleFold:       keysSingleFold,
+		MaxConcurrentScans:   maxScans,
+		AcceptRateLimit:      acceptRateLimit,
+		ProtectedMode:        protectedMode,
+		LogUnknownCommands:   logUnknownCmds,
+		JoinRetries:          joinRetries,
+		JoinRetryInterval:    joinRetryIntvl,
+		AppendOnly:           appendOnly,
+		AppendFsync:          appendFsync,
+		AOFRotateSize:        aofRotateSize,
+	}
+
+	if err := ListenAndServe(bind, join, dir, logdir, lconsistency, ldurability, &opts); err != nil {
 		log.Warningf("%v", err)
 	}
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// metaPrefix starts the keys of the records kept for each user key: the
+// write index and time of its last write, and whether that write deleted
+// it. A
+// deleted key keeps its record as a tombstone, so that EXPORT SINCE can
+// report the deletion.
+const metaPrefix = reservedPrefix + "m:"
+
+// metaFlagDeleted marks the record of a deleted key.
+const metaFlagDeleted = 1
+
+// keyMeta is the record kept for a user key.
+type keyMeta struct {
+	index   uint64 // write index of the last write of the key
+	deleted bool   // the last write deleted the key
+	mtime   int64  // unix nanoseconds of the last write, 0 if unknown
+}
+
+// metaKey returns the key of the record kept for key.
+func metaKey(key string) string {
+	return metaPrefix + key
+}
+
+// encode returns the record: the write index, the flags and the time.
+func (m keyMeta) encode() []byte {
+	b := make([]byte, 17)
+	binary.BigEndian.PutUint64(b, m.index)
+	if m.deleted {
+		b[8] |= metaFlagDeleted
+	}
+	binary.BigEndian.PutUint64(b[9:], uint64(m.mtime))
+	return b
+}
+
+// decodeMeta parses a record.
+func decodeMeta(b []byte) (keyMeta, error) {
+	if len(b) != 17 {
+		return keyMeta{}, errors.New("invalid key record")
+	}
+	return keyMeta{
+		index:   binary.BigEndian.Uint64(b),
+		deleted: b[8]&metaFlagDeleted != 0,
+		mtime:   int64(binary.BigEndian.Uint64(b[9:])),
+	}, nil
+}
+
+// stampWrite updates the records of the keys written by the applied SET or
+// DEL in args, which has write index index and was stamped with mtime. The
+// caller must hold kvm.mu for writing. The write has already been applied,
+// so failures are only logged.
+func (kvm *Machine) stampWrite(index uint64, mtime int64, args [][]byte) {
+	var keys [][]byte
+	m := keyMeta{index: index, mtime: mtime}
+	switch strings.ToLower(string(args[0])) {
+	case "set":
+		keys = args[1:2]
+	case "del":
+		keys = args[1:]
+		m.deleted = true
+	}
+	for _, key := range keys {
+		if err := kvm.db.Put(metaKey(string(key)), m.encode()); err != nil {
+			log.Warningf("could not record the write index of %q: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/prologic/bitcask"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errMigrateBusyKey = &respError{"BUSYKEY", "Target key name already exists."}
+	errMigrateDB      = &respError{"ERR", "bitraft has a single database, destination-db must be 0"}
+)
+
+// migrateOptions are the parsed arguments of MIGRATE.
+type migrateOptions struct {
+	addr    string
+	keys    []string
+	prefix  string // USEPREFIX prefix of the keys, not sent to the target
+	timeout time.Duration
+	copy    bool
+	replace bool
+}
+
+func parseMigrate(args [][]byte) (*migrateOptions, error) {
+	if len(args) < 6 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	opts := &migrateOptions{
+		addr: net.JoinHostPort(string(args[1]), string(args[2])),
+	}
+	if string(args[4]) != "0" {
+		return nil, errMigrateDB
+	}
+	ms, err := strconv.ParseUint(string(args[5]), 10, 32)
+	if err != nil {
+		return nil, errSyntaxError
+	}
+	opts.timeout = time.Duration(ms) * time.Millisecond
+	for i := 6; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		default:
+			return nil, errSyntaxError
+		case "copy":
+			opts.copy = true
+		case "replace":
+			opts.replace = true
+		case "keys":
+			// The key argument must be empty when KEYS is given.
+			if len(args[3]) != 0 || i == len(args)-1 {
+				return nil, errSyntaxError
+			}
+			for _, key := range args[i+1:] {
+				opts.keys = append(opts.keys, string(key))
+			}
+			return opts, nil
+		}
+	}
+	opts.keys = []string{string(args[3])}
+	return opts, nil
+}
+
+// cmdMigrate moves keys to another bitraft (or Redis) server: values are
+// written to the target with SET and then, unless COPY is given, deleted
+// locally through the Raft log. With KEYS, all keys are transferred in one
+// pipeline and deleted in one replicated DEL; keys the target rejected are
+// kept.
+//
+// Only a synthesized DEL goes through the log, so followers replaying it
+// never dial the target. Unlike Redis, the source keys are
+// not locked during the transfer: a write that lands between the read and
+// the delete is lost.
+func (kvm *Machine) cmdMigrate(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	opts, err := parseMigrate(cmd.Args)
+	if err != nil {
+		return nil, err
+	}
+	if st := stateOf(conn); st != nil {
+		opts.prefix = st.prefix
+	}
+
+	// Only the leader migrates, so a stale follower cannot send old values.
+	if err := kvm.checkLeader(); err != nil {
+		return nil, err
+	}
+	values, err := kvm.migrateRead(opts.keys)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		conn.WriteString("NOKEY")
+		return nil, nil
+	}
+
+	migrated, err := migrateValues(opts, values)
+	if !opts.copy && len(migrated) > 0 {
+		if _, err := kvm.deleteMigrated(m, conn, migrated); err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// migrateRead returns the values of the keys that exist.
+func (kvm *Machine) migrateRead(keys []string) (map[string][]byte, error) {
+	kvm.mu.RLock()
+	defer kvm.mu.RUnlock()
+	values := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		value, err := kvm.db.Get(key)
+		if err != nil {
+			if err == bitcask.ErrKeyNotFound {
+				continue
+			}
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// migrateValues writes values to the target server in a pipeline and
+// returns the keys it accepted. If some keys were not migrated, it also
+// returns the first error.
+func migrateValues(opts *migrateOptions, values map[string][]byte) ([]string, error) {
+	var dialOpts []redis.DialOption
+	if opts.timeout > 0 {
+		dialOpts = append(dialOpts,
+			redis.DialConnectTimeout(opts.timeout),
+			redis.DialReadTimeout(opts.timeout),
+			redis.DialWriteTimeout(opts.timeout),
+		)
+	}
+	target, err := redis.Dial("tcp", opts.addr, dialOpts...)
+	if err != nil {
+		return nil, &respError{"IOERR", "error or timeout connecting to the target: " + err.Error()}
+	}
+	defer target.Close()
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	// Without REPLACE, skip keys the target already has.
+	var firstErr error
+	if !opts.replace {
+		for _, key := range keys {
+			target.Send("GET", strings.TrimPrefix(key, opts.prefix))
+		}
+		if err := target.Flush(); err != nil {
+			return nil, migrateIOError(err)
+		}
+		free := keys[:0]
+		for _, key := range keys {
+			_, err := redis.Bytes(target.Receive())
+			switch {
+			case err == redis.ErrNil:
+				free = append(free, key)
+			case err == nil:
+				if firstErr == nil {
+					firstErr = errMigrateBusyKey
+				}
+			default:
+				return nil, migrateIOError(err)
+			}
+		}
+		keys = free
+	}
+
+	for _, key := range keys {
+		target.Send("SET", strings.TrimPrefix(key, opts.prefix), values[key])
+	}
+	if err := target.Flush(); err != nil {
+		return nil, migrateIOError(err)
+	}
+	var migrated []string
+	for _, key := range keys {
+		if _, err := target.Receive(); err != nil {
+			if _, ok := err.(redis.Error); !ok {
+				// The connection failed, so whether the remaining keys
+				// were written is unknown: keep them all.
+				return migrated, migrateIOError(err)
+			}
+			if firstErr == nil {
+				firstErr = migrateIOError(err)
+			}
+			continue
+		}
+		migrated = append(migrated, key)
+	}
+	return migrated, firstErr
+}
+
+func migrateIOError(err error) error {
+	if _, ok := err.(redis.Error); ok {
+		return &respError{"ERR", "target replied: " + err.Error()}
+	}
+	return &respError{"IOERR", "error or timeout writing to the target: " + err.Error()}
+}
+
+// deleteMigrated deletes the migrated keys with a single replicated DEL.
+func (kvm *Machine) deleteMigrated(m finn.Applier, conn redcon.Conn, keys []string) (interface{}, error) {
+	args := [][]byte{[]byte("del")}
+	for _, key := range keys {
+		args = append(args, []byte(key))
+	}
+	del := buildCommand(args...)
+	return m.Apply(conn, del,
+		func() (interface{}, error) {
+			kvm.mu.Lock()
+			defer kvm.mu.Unlock()
+			for _, key := range args[1:] {
+				if err := kvm.db.Delete(string(key)); err != nil {
+					return nil, kvm.writeErr(err)
+				}
+			}
+			if err := kvm.syncWrite(); err != nil {
+				return nil, kvm.writeErr(err)
+			}
+			kvm.recordWrite(del.Args)
+			return nil, nil
+		},
+		func(interface{}) (interface{}, error) {
+			return nil, nil
+		},
+	)
+}
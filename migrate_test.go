@@ -0,0 +1,297 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/redcon"
+)
+
+func TestMigrate(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	defer asLeader(kvm)()
+	conn := &testConn{}
+
+	replies, err := do(kvm, conn, "MIGRATE", "127.0.0.1", "4921", "foo", "0", "100")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"+NOKEY"}, replies)
+
+	replies, _ = do(kvm, conn, "MIGRATE", "127.0.0.1", "4921", "foo", "1", "100")
+	assert.Equal([]interface{}{"-" + errMigrateDB.Error()}, replies)
+
+	_, err = do(kvm, conn, "MIGRATE", "127.0.0.1", "4921", "foo", "0", "100", "MOVE")
+	assert.Equal(errSyntaxError, err)
+
+	replies, _ = do(kvm, conn, "MIGRATE", "127.0.0.1", "4921", "", "0", "100", "KEYS", "foo", "bar")
+	assert.Equal([]interface{}{"+NOKEY"}, replies)
+
+	_, err = do(kvm, conn, "MIGRATE", "127.0.0.1", "4921", "foo", "0", "100", "KEYS", "bar")
+	assert.Equal(errSyntaxError, err)
+}
+
+// asLeader makes kvm see itself as the leader until the returned func is
+// called.
+func asLeader(kvm *Machine) func() {
+	leaderOf = func(string) (string, error) { return kvm.addr, nil }
+	return func() { leaderOf = raftLeader }
+}
+
+func TestMigrateFollower(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+	do(kvm, conn, "set", "foo", "bar")
+
+	leaderOf = func(string) (string, error) { return "10.0.0.1:4920", nil }
+	defer func() { leaderOf = raftLeader }()
+	replies, _ := do(kvm, conn, "MIGRATE", "127.0.0.1", "4921", "foo", "0", "100")
+	assert.Equal([]interface{}{"-TRY 10.0.0.1:4920"}, replies)
+
+	leaderOf = func(string) (string, error) { return "", nil }
+	_, err := do(kvm, conn, "MIGRATE", "127.0.0.1", "4921", "foo", "0", "100")
+	assert.True(isLeaderUnknown(err))
+}
+
+func TestMigratePrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	cmd := prefixMigrate(buildCommand([]byte("MIGRATE"), []byte("h"), []byte("1"), []byte(""), []byte("0"),
+		[]byte("100"), []byte("COPY"), []byte("KEYS"), []byte("a"), []byte("b")), "t:")
+	assert.Equal("MIGRATE h 1  0 100 COPY KEYS t:a t:b", joinArgs(cmd.Args))
+	cmd = prefixMigrate(buildCommand([]byte("MIGRATE"), []byte("h"), []byte("1"), []byte("a"), []byte("0"),
+		[]byte("100")), "t:")
+	assert.Equal("MIGRATE h 1 t:a 0 100", joinArgs(cmd.Args))
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	defer asLeader(kvm)()
+	do(kvm, &testConn{}, "set", "foo", "bar")
+
+	conn := &testConn{}
+	do(kvm, conn, "useprefix", "t:")
+	replies, _ := do(kvm, conn, "MIGRATE", "127.0.0.1", "4921", "foo", "0", "100")
+	assert.Equal([]interface{}{"+NOKEY"}, replies)
+	replies, _ = do(kvm, conn, "MIGRATE", "127.0.0.1", "4921", "", "0", "100", "KEYS", "foo")
+	assert.Equal([]interface{}{"+NOKEY"}, replies)
+
+	replies, _ = do(kvm, &testConn{}, "get", "foo")
+	assert.Equal([]interface{}{"bar"}, replies)
+}
+
+func joinArgs(args [][]byte) string {
+	s := make([]string, len(args))
+	for i, arg := range args {
+		s[i] = string(arg)
+	}
+	return strings.Join(s, " ")
+}
+
+// migrateTarget is an in-process server for MIGRATE to write to. It keeps
+// its keys in a map and refuses to SET the keys in reject.
+type migrateTarget struct {
+	mu     sync.Mutex
+	addr   string
+	values map[string]string
+	reject map[string]bool
+	srv    *redcon.Server
+}
+
+func newMigrateTarget(t *testing.T) *migrateTarget {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg := &migrateTarget{
+		addr:   ln.Addr().String(),
+		values: make(map[string]string),
+		reject: make(map[string]bool),
+	}
+	ln.Close()
+	tg.srv = redcon.NewServer(tg.addr, tg.handle, nil, nil)
+	signal := make(chan error, 1)
+	go tg.srv.ListenServeAndSignal(signal)
+	if err := <-signal; err != nil {
+		t.Fatal(err)
+	}
+	return tg
+}
+
+func (tg *migrateTarget) handle(conn redcon.Conn, cmd redcon.Command) {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	switch strings.ToLower(string(cmd.Args[0])) {
+	default:
+		conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
+	case "get":
+		if value, ok := tg.values[string(cmd.Args[1])]; ok {
+			conn.WriteBulkString(value)
+		} else {
+			conn.WriteNull()
+		}
+	case "set":
+		if tg.reject[string(cmd.Args[1])] {
+			conn.WriteError("ERR rejected")
+			return
+		}
+		tg.values[string(cmd.Args[1])] = string(cmd.Args[2])
+		conn.WriteString("OK")
+	}
+}
+
+// get returns the target's value of key, and whether it has one.
+func (tg *migrateTarget) get(key string) (string, bool) {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	value, ok := tg.values[key]
+	return value, ok
+}
+
+// migrateArgs returns the MIGRATE command sending key and args to tg.
+func (tg *migrateTarget) migrateArgs(key string, args ...string) []string {
+	host, port, _ := net.SplitHostPort(tg.addr)
+	return append([]string{"MIGRATE", host, port, key, "0", "1000"}, args...)
+}
+
+// logApplier is testApplier recording the commands it applies, without
+// their stamp.
+type logApplier struct {
+	testApplier
+	applied []string
+}
+
+func (a *logApplier) Apply(conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	logged, _ := unstamp(cmd)
+	a.applied = append(a.applied, joinArgs(logged.Args))
+	return a.testApplier.Apply(conn, cmd, mutate, respond)
+}
+
+// doApplied runs a command against kvm through a logApplier and returns
+// the replies written to conn, the commands applied and the error.
+func doApplied(kvm *Machine, conn *testConn, args ...string) ([]interface{}, []string, error) {
+	cmd := redcon.Command{}
+	for _, arg := range args {
+		cmd.Args = append(cmd.Args, []byte(arg))
+	}
+	conn.replies = nil
+	a := &logApplier{}
+	_, err := kvm.Command(a, conn, cmd)
+	return conn.replies, a.applied, err
+}
+
+func TestMigrateTarget(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	defer asLeader(kvm)()
+	tg := newMigrateTarget(t)
+	defer tg.srv.Close()
+	conn := &testConn{}
+
+	get := func(key string) interface{} {
+		replies, _ := do(kvm, &testConn{}, "get", key)
+		return replies[0]
+	}
+
+	t.Run("Move", func(t *testing.T) {
+		do(kvm, conn, "set", "a", "1")
+		do(kvm, conn, "set", "b", "2")
+		do(kvm, conn, "set", "c", "3")
+
+		replies, applied, err := doApplied(kvm, conn, tg.migrateArgs("", "KEYS", "a", "b", "missing")...)
+		assert.NoError(err)
+		assert.Equal([]interface{}{"+OK"}, replies)
+
+		// The keys are set on the target in one pipeline, then deleted
+		// with a single replicated del.
+		value, _ := tg.get("a")
+		assert.Equal("1", value)
+		value, _ = tg.get("b")
+		assert.Equal("2", value)
+		_, ok := tg.get("missing")
+		assert.False(ok)
+		if assert.Len(applied, 1) {
+			assert.True(applied[0] == "del a b" || applied[0] == "del b a", applied[0])
+		}
+		assert.Nil(get("a"))
+		assert.Nil(get("b"))
+		assert.Equal("3", get("c"))
+	})
+
+	t.Run("BusyKey", func(t *testing.T) {
+		do(kvm, conn, "set", "a", "new")
+
+		replies, applied, err := doApplied(kvm, conn, tg.migrateArgs("a")...)
+		assert.NoError(err)
+		assert.Equal([]interface{}{"-" + errMigrateBusyKey.Error()}, replies)
+		assert.Len(applied, 0)
+		value, _ := tg.get("a")
+		assert.Equal("1", value)
+		assert.Equal("new", get("a"))
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		replies, applied, err := doApplied(kvm, conn, tg.migrateArgs("a", "REPLACE")...)
+		assert.NoError(err)
+		assert.Equal([]interface{}{"+OK"}, replies)
+		assert.Equal([]string{"del a"}, applied)
+		value, _ := tg.get("a")
+		assert.Equal("new", value)
+		assert.Nil(get("a"))
+	})
+
+	t.Run("Copy", func(t *testing.T) {
+		replies, applied, err := doApplied(kvm, conn, tg.migrateArgs("c", "COPY")...)
+		assert.NoError(err)
+		assert.Equal([]interface{}{"+OK"}, replies)
+		assert.Len(applied, 0)
+		value, _ := tg.get("c")
+		assert.Equal("3", value)
+		assert.Equal("3", get("c"))
+	})
+}
+
+func TestMigratePartial(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	defer asLeader(kvm)()
+	tg := newMigrateTarget(t)
+	defer tg.srv.Close()
+	tg.reject["b"] = true
+	conn := &testConn{}
+
+	do(kvm, conn, "set", "a", "1")
+	do(kvm, conn, "set", "b", "2")
+	do(kvm, conn, "set", "c", "3")
+
+	replies, applied, err := doApplied(kvm, conn, tg.migrateArgs("", "KEYS", "a", "b", "c")...)
+	assert.NoError(err)
+	assert.Equal([]interface{}{"-ERR target replied: ERR rejected"}, replies)
+
+	// Only the keys the target accepted are deleted.
+	if assert.Len(applied, 1) {
+		assert.True(applied[0] == "del a c" || applied[0] == "del c a", applied[0])
+	}
+	value, _ := tg.get("a")
+	assert.Equal("1", value)
+	value, _ = tg.get("c")
+	assert.Equal("3", value)
+	_, ok := tg.get("b")
+	assert.False(ok)
+
+	replies, _ = do(kvm, conn, "mget", "a", "b", "c")
+	assert.Equal([]interface{}{[]int{3}, nil, "2", nil}, replies)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// monitors fans the commands served by the node out to MONITOR
+// connections.
+type monitors struct {
+	n    int32 // atomic: number of monitors, checked without the lock
+	mu   sync.Mutex
+	subs map[chan string]struct{}
+}
+
+// active reports whether there are any monitors.
+func (ms *monitors) active() bool {
+	return atomic.LoadInt32(&ms.n) > 0
+}
+
+// publish sends a line to every monitor, dropping monitors that have
+// fallen feedBacklog lines behind.
+func (ms *monitors) publish(line string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for ch := range ms.subs {
+		select {
+		case ch <- line:
+		default:
+			ms.remove(ch)
+		}
+	}
+}
+
+func (ms *monitors) subscribe() chan string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.subs == nil {
+		ms.subs = make(map[chan string]struct{})
+	}
+	ch := make(chan string, feedBacklog)
+	ms.subs[ch] = struct{}{}
+	atomic.AddInt32(&ms.n, 1)
+	return ch
+}
+
+func (ms *monitors) unsubscribe(ch chan string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.subs[ch]; ok {
+		ms.remove(ch)
+	}
+}
+
+// remove drops a monitor. The caller must hold ms.mu.
+func (ms *monitors) remove(ch chan string) {
+	delete(ms.subs, ch)
+	close(ch)
+	atomic.AddInt32(&ms.n, -1)
+}
+
+// monitorLine formats a command the way Redis' MONITOR does: the time, the
+// database and client address, and the quoted arguments.
+func monitorLine(now time.Time, addr string, args [][]byte) string {
+	buf := strconv.AppendInt(nil, now.Unix(), 10)
+	buf = append(buf, '.')
+	usec := strconv.Itoa(now.Nanosecond() / 1000)
+	for i := len(usec); i < 6; i++ {
+		buf = append(buf, '0')
+	}
+	buf = append(buf, usec...)
+	buf = append(buf, " [0 "...)
+	buf = append(buf, addr...)
+	buf = append(buf, ']')
+	for _, arg := range args {
+		buf = append(buf, ' ')
+		buf = appendRepr(buf, arg)
+	}
+	return string(buf)
+}
+
+// appendRepr appends arg to buf double quoted, with quotes, backslashes
+// and non-printable bytes escaped, so binary arguments stay on one line.
+func appendRepr(buf, arg []byte) []byte {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	for _, c := range arg {
+		switch c {
+		case '\\', '"':
+			buf = append(buf, '\\', c)
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		case '\t':
+			buf = append(buf, '\\', 't')
+		case '\a':
+			buf = append(buf, '\\', 'a')
+		case '\b':
+			buf = append(buf, '\\', 'b')
+		default:
+			if c < 0x20 || c > 0x7e {
+				buf = append(buf, '\\', 'x', hex[c>>4], hex[c&0xf])
+			} else {
+				buf = append(buf, c)
+			}
+		}
+	}
+	return append(buf, '"')
+}
+
+// cmdMonitor turns the connection into a monitor of every command the node
+// serves to clients, one status reply per command.
+func (kvm *Machine) cmdMonitor(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	log.Warningf("MONITOR started by %s, every command is now copied to it", conn.RemoteAddr())
+	ensureState(conn).detached = true
+	ch := kvm.monitors.subscribe()
+	go kvm.serveMonitor(conn.Detach(), ch)
+	return nil, nil
+}
+
+// serveMonitor writes the lines received on ch to a detached monitor until
+// it disconnects or falls behind.
+func (kvm *Machine) serveMonitor(conn redcon.DetachedConn, ch chan string) {
+	defer conn.Close()
+	if nc := conn.NetConn(); nc != nil {
+		nc.SetReadDeadline(time.Time{})
+	}
+	go func() {
+		// Monitors send nothing more, so any read ends the monitor.
+		conn.ReadCommand()
+		kvm.monitors.unsubscribe(ch)
+	}()
+
+	conn.WriteString("OK")
+	for {
+		if err := kvm.flushDetached(conn); err != nil {
+			kvm.monitors.unsubscribe(ch)
+			return
+		}
+		line, ok := <-ch
+		if !ok {
+			return
+		}
+		conn.WriteString(line)
+	}
+}
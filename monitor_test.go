@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonitorLine(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1339518083, 107412000)
+	args := [][]byte{[]byte("set"), []byte("k\"\\"), []byte("a b\r\n\x00\xff")}
+	assert.Equal(`1339518083.107412 [0 127.0.0.1:60866] "set" "k\"\\" "a b\r\n\x00\xff"`,
+		monitorLine(now, "127.0.0.1:60866", args))
+	assert.Equal(`1339518083.000042 [0 [::1]:1] "get"`,
+		monitorLine(time.Unix(1339518083, 42000), "[::1]:1", [][]byte{[]byte("get")}))
+}
+
+func TestMonitor(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	do(kvm, conn, "set", "before", "1")
+	assert.False(kvm.monitors.active())
+	ch := kvm.monitors.subscribe()
+	assert.True(kvm.monitors.active())
+	do(kvm, conn, "get", "foo")
+	do(kvm, conn, "bogus")
+
+	if assert.Len(ch, 2) {
+		assert.Contains(<-ch, `[0 127.0.0.1:50000] "get" "foo"`)
+		assert.Contains(<-ch, `"bogus"`)
+	}
+
+	kvm.monitors.unsubscribe(ch)
+	assert.False(kvm.monitors.active())
+	do(kvm, conn, "get", "foo")
+	_, ok := <-ch
+	assert.False(ok)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errOperationCanceled = errors.New("operation canceled")
+	errNoSuchOperation   = errors.New("no such operation")
+)
+
+// operation is a long-running operation that OPS can list and cancel.
+type operation struct {
+	id     int64
+	name   string
+	start  time.Time
+	cancel context.CancelFunc
+}
+
+// opRegistry tracks the running operations. Its zero value is ready to use.
+type opRegistry struct {
+	mu   sync.Mutex
+	next int64
+	ops  map[int64]*operation
+}
+
+// trackOp registers an operation named name for as long as it runs. It
+// returns a context derived from ctx that OPS CANCEL cancels, and a function
+// to call when the operation ends.
+func (kvm *Machine) trackOp(ctx context.Context, name string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &kvm.ops
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ops == nil {
+		r.ops = make(map[int64]*operation)
+	}
+	r.next++
+	op := &operation{id: r.next, name: name, start: time.Now(), cancel: cancel}
+	r.ops[op.id] = op
+	return ctx, func() {
+		cancel()
+		r.mu.Lock()
+		delete(r.ops, op.id)
+		r.mu.Unlock()
+	}
+}
+
+// ctxErr returns the error for an operation stopped because ctx is done.
+func ctxErr(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return errCommandTimedOut
+	}
+	return errOperationCanceled
+}
+
+// opsHelp describes the OPS subcommands for OPS HELP.
+var opsHelp = []string{
+	"LIST",
+	"    Return the id, name and elapsed milliseconds of running operations.",
+	"CANCEL <id>",
+	"    Cancel the operation <id>.",
+}
+
+// cmdOps implements the OPS container command, which lists and cancels the
+// node's long-running operations.
+func (kvm *Machine) cmdOps(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	default:
+		return nil, errSyntaxError
+	case "help":
+		writeHelp(conn, "OPS", opsHelp)
+		return nil, nil
+	case "list":
+		return kvm.cmdOpsList(m, conn, cmd)
+	case "cancel":
+		return kvm.cmdOpsCancel(m, conn, cmd)
+	}
+}
+
+// cmdOpsList replies with the id, name and elapsed milliseconds of every
+// running operation, oldest first.
+func (kvm *Machine) cmdOpsList(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	kvm.ops.mu.Lock()
+	ops := make([]operation, 0, len(kvm.ops.ops))
+	for _, op := range kvm.ops.ops {
+		ops = append(ops, *op)
+	}
+	kvm.ops.mu.Unlock()
+	sort.Slice(ops, func(i, j int) bool { return ops[i].id < ops[j].id })
+
+	now := time.Now()
+	conn.WriteArray(len(ops))
+	for _, op := range ops {
+		conn.WriteArray(3)
+		conn.WriteInt(int(op.id))
+		conn.WriteBulk([]byte(op.name))
+		conn.WriteInt(int(now.Sub(op.start) / time.Millisecond))
+	}
+	return nil, nil
+}
+
+// cmdOpsCancel cancels a running operation by id.
+func (kvm *Machine) cmdOpsCancel(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	id, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+	if err != nil {
+		return nil, errSyntaxError
+	}
+	kvm.ops.mu.Lock()
+	op, ok := kvm.ops.ops[id]
+	kvm.ops.mu.Unlock()
+	if !ok {
+		return nil, errNoSuchOperation
+	}
+	op.cancel()
+	conn.WriteString("OK")
+	return nil, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOps(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	ctx, done := kvm.trackOp(context.Background(), "keys")
+	replies, err := do(kvm, conn, "ops", "list")
+	assert.NoError(err)
+	assert.Len(replies, 5)
+	assert.Equal([]int{1}, replies[0])
+	assert.Equal(1, replies[2])
+	assert.Equal("keys", replies[3])
+
+	replies, err = do(kvm, conn, "ops", "cancel", "1")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"+OK"}, replies)
+	assert.Equal(errOperationCanceled, ctxErr(ctx))
+
+	done()
+	replies, _ = do(kvm, conn, "ops", "list")
+	assert.Equal([]interface{}{[]int{0}}, replies)
+	_, err = do(kvm, conn, "ops", "cancel", "1")
+	assert.Equal(errNoSuchOperation, err)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/redcon"
+)
+
+// peersFilename is the file in the Raft log directory where finn keeps the
+// addresses of the cluster's nodes, as a JSON array of host:port strings.
+const peersFilename = "peers.json"
+
+// peerHosts is the set of IP addresses of the node's Raft peers: the join
+// addresses, and the nodes listed in peers.json. The file is reread when it
+// changes, so that nodes added to the cluster later are recognised.
+type peerHosts struct {
+	mu     sync.Mutex
+	path   string
+	static map[string]bool // IPs of the join addresses
+	ips    map[string]bool // static plus the IPs from peers.json
+	mtime  time.Time
+}
+
+// newPeerHosts returns the peers of a node keeping its Raft state in logdir
+// and joining via join.
+func newPeerHosts(logdir string, join []string) *peerHosts {
+	p := &peerHosts{
+		path:   filepath.Join(logdir, peersFilename),
+		static: make(map[string]bool),
+	}
+	resolveHosts(p.static, join)
+	p.ips = p.static
+	return p
+}
+
+// resolveHosts adds the IP addresses of the hosts of addrs to ips. Hosts
+// that do not resolve are skipped.
+func resolveHosts(ips map[string]bool, addrs []string) {
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			ips[ip.String()] = true
+			continue
+		}
+		resolved, err := net.LookupHost(host)
+		if err != nil {
+			log.Warningf("could not resolve peer %s: %v", host, err)
+			continue
+		}
+		for _, s := range resolved {
+			if ip := net.ParseIP(s); ip != nil {
+				ips[ip.String()] = true
+			}
+		}
+	}
+}
+
+// reload rereads peers.json if it changed since it was last read.
+func (p *peerHosts) reload() {
+	fi, err := os.Stat(p.path)
+	if err != nil || fi.ModTime().Equal(p.mtime) {
+		return
+	}
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return
+	}
+	var addrs []string
+	if err := json.Unmarshal(data, &addrs); err != nil {
+		log.Warningf("could not read %s: %v", p.path, err)
+		return
+	}
+	ips := make(map[string]bool, len(p.static)+len(addrs))
+	for ip := range p.static {
+		ips[ip] = true
+	}
+	resolveHosts(ips, addrs)
+	p.ips = ips
+	p.mtime = fi.ModTime()
+}
+
+// contains reports whether the client on conn connects from the address of
+// a Raft peer. A nil set contains nothing.
+func (p *peerHosts) contains(conn redcon.Conn) bool {
+	if p == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reload()
+	return p.ips[ip.String()]
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerHosts(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "bitraft")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	p := newPeerHosts(dir, []string{"10.0.0.1:4920"})
+	assert.True(p.contains(&testConn{addr: "10.0.0.1:50000"}))
+	assert.False(p.contains(&testConn{addr: "10.0.0.2:50000"}))
+
+	// A node added to the cluster later is picked up from peers.json.
+	path := filepath.Join(dir, peersFilename)
+	assert.NoError(ioutil.WriteFile(path, []byte(`["10.0.0.2:4920"]`), 0644))
+	assert.True(p.contains(&testConn{addr: "10.0.0.2:50000"}))
+	assert.True(p.contains(&testConn{addr: "10.0.0.1:50000"}))
+
+	assert.NoError(ioutil.WriteFile(path, []byte(`["10.0.0.3:4920"]`), 0644))
+	later := time.Now().Add(time.Second)
+	assert.NoError(os.Chtimes(path, later, later))
+	assert.False(p.contains(&testConn{addr: "10.0.0.2:50000"}))
+	assert.True(p.contains(&testConn{addr: "10.0.0.3:50000"}))
+
+	var none *peerHosts
+	assert.False(none.contains(&testConn{}))
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net"
+
+	"github.com/tidwall/redcon"
+)
+
+var errProtectedMode = &respError{"DENIED", "bitraft is running in protected mode, " +
+	"so commands from non-loopback addresses are refused as no password can be set. " +
+	"Restart the node with --protected-mode=false to accept them, " +
+	"after making sure it is only reachable from trusted networks."}
+
+// isLoopback reports whether the client on conn connects from a loopback
+// address.
+func isLoopback(conn redcon.Conn) bool {
+	ip := remoteIP(conn)
+	return ip != nil && ip.IsLoopback()
+}
+
+// remoteIP returns the IP address the client on conn connects from, or nil
+// if it cannot be parsed.
+func remoteIP(conn redcon.Conn) net.IP {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
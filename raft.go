@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// raftQueryTimeout bounds a query against the local node's RAFT* commands.
+const raftQueryTimeout = time.Second * 2
+
+// raftDo runs one of finn's built-in RAFT* commands against the node at
+// addr. finn keeps its *raft.Raft private, so the state machine asks the
+// node over its own Redis port instead.
+func raftDo(addr, command string, args ...interface{}) (interface{}, error) {
+	conn, err := redis.Dial("tcp", addr,
+		redis.DialConnectTimeout(raftQueryTimeout),
+		redis.DialReadTimeout(raftQueryTimeout),
+		redis.DialWriteTimeout(raftQueryTimeout),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Do(command, args...)
+}
+
+// raftStats returns the node's raft statistics as reported by RAFTSTATS.
+func raftStats(addr string) (map[string]string, error) {
+	return redis.StringMap(raftDo(addr, "RAFTSTATS"))
+}
+
+// raftLeader returns the address of the current leader, or an empty string
+// if there is none.
+func raftLeader(addr string) (string, error) {
+	leader, err := redis.String(raftDo(addr, "RAFTLEADER"))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return leader, err
+}
+
+// leaderOf returns the leader as seen from the node at addr. Tests
+// replace it to simulate a cluster.
+var leaderOf = raftLeader
+
+// checkLeader fails unless the local node is the leader, in the same way
+// finn refuses writes sent to a follower.
+func (kvm *Machine) checkLeader() error {
+	leader, err := leaderOf(kvm.addr)
+	switch {
+	case err != nil:
+		return err
+	case leader == "":
+		return errors.New("leader unknown")
+	case leader != kvm.addr:
+		return &respError{"TRY", leader}
+	}
+	return nil
+}
+
+// leaderPollInterval is how often waitForLeader asks the local node for
+// the leader.
+const leaderPollInterval = time.Millisecond * 100
+
+// isLeaderUnknown reports whether err is finn's error for a command that
+// needs the leader while the cluster has none, as during an election.
+// finn does not export the error, so it is matched by its text.
+func isLeaderUnknown(err error) bool {
+	return err != nil && err.Error() == "leader unknown"
+}
+
+// waitForLeader waits until the cluster has a leader, as seen from the
+// node at addr, and reports whether it has one before ctx is done.
+func waitForLeader(ctx context.Context, addr string) bool {
+	ticker := time.NewTicker(leaderPollInterval)
+	defer ticker.Stop()
+	for {
+		if leader, err := raftLeader(addr); err == nil && leader != "" {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// raftHelp describes the RAFT subcommands for RAFT HELP.
+var raftHelp = []string{
+	"INFO",
+	"    Return the cluster size, this node's state and the cluster's health.",
+	"STATUS",
+	"    Return this node's role, term, commit index and applied index.",
+}
+
+// cmdRaft implements the RAFT container command. Its subcommands report on
+// the local node and are not replicated.
+func (kvm *Machine) cmdRaft(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	default:
+		return nil, errSyntaxError
+	case "help":
+		writeHelp(conn, "RAFT", raftHelp)
+		return nil, nil
+	case "info":
+		return kvm.cmdRaftInfo(m, conn, cmd)
+	case "status":
+		return kvm.cmdRaftStatus(m, conn, cmd)
+	}
+}
+
+// cmdRaftStatus replies with the node's role, term, commit index and
+// applied index as field/value pairs, for scripts waiting for a node to
+// catch up.
+func (kvm *Machine) cmdRaftStatus(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	stats, err := raftStats(kvm.addr)
+	if err != nil {
+		return nil, err
+	}
+	fields := []string{
+		"role", strings.ToLower(stats["state"]),
+		"term", stats["term"],
+		"commit_index", stats["commit_index"],
+		"applied_index", stats["applied_index"],
+	}
+	conn.WriteArray(len(fields))
+	for _, field := range fields {
+		conn.WriteBulk([]byte(field))
+	}
+	return nil, nil
+}
+
+// cmdRaftInfo replies with the cluster size, the node's term, commit and
+// applied indexes, the leader, and whether the cluster is healthy. A
+// cluster is considered healthy while it has a leader, which requires a
+// reachable majority.
+func (kvm *Machine) cmdRaftInfo(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	stats, err := raftStats(kvm.addr)
+	if err != nil {
+		return nil, err
+	}
+	leader, err := raftLeader(kvm.addr)
+	if err != nil {
+		return nil, err
+	}
+	nodes := 1
+	if peers, err := strconv.Atoi(stats["num_peers"]); err == nil {
+		nodes += peers
+	}
+	health := "healthy"
+	if leader == "" {
+		health = "degraded"
+	}
+	fields := []string{
+		"nodes", strconv.Itoa(nodes),
+		"state", stats["state"],
+		"term", stats["term"],
+		"commit_index", stats["commit_index"],
+		"applied_index", stats["applied_index"],
+		"leader", leader,
+		"health", health,
+	}
+	conn.WriteArray(len(fields))
+	for _, field := range fields {
+		conn.WriteBulk([]byte(field))
+	}
+	return nil, nil
+}
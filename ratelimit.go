@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// rateLimiter is a token bucket allowing rate events per second on average,
+// with bursts of up to rate events.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate)}
+}
+
+// Allow takes a token at time now and reports whether one was available.
+func (l *rateLimiter) Allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// acceptConn reports whether l, if not nil, lets the connection on conn in
+// at time now. Connections from loopback addresses and from self, the IP
+// the node listens on, are exempt: the node dials its own address for
+// RAFTSTATS and RAFTLEADER, which must neither be refused nor take tokens
+// from clients.
+func acceptConn(l *rateLimiter, self net.IP, conn redcon.Conn, now time.Time) bool {
+	if l == nil || isLoopback(conn) {
+		return true
+	}
+	if ip := remoteIP(conn); ip != nil && self != nil && ip.Equal(self) {
+		return true
+	}
+	return l.Allow(now)
+}
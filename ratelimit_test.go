@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newRateLimiter(2)
+	now := time.Now()
+	assert.True(l.Allow(now))
+	assert.True(l.Allow(now))
+	assert.False(l.Allow(now))
+
+	now = now.Add(time.Second / 2)
+	assert.True(l.Allow(now))
+	assert.False(l.Allow(now))
+
+	// Idle time does not build up more than one second of tokens.
+	now = now.Add(time.Minute)
+	assert.True(l.Allow(now))
+	assert.True(l.Allow(now))
+	assert.False(l.Allow(now))
+}
+
+func TestAcceptConn(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newRateLimiter(1)
+	now := time.Now()
+	local := &testConn{}
+	remote := &testConn{addr: "10.0.0.1:50000"}
+
+	assert.True(acceptConn(nil, nil, remote, now))
+	// The node's own loopback connections take no tokens.
+	for i := 0; i < 3; i++ {
+		assert.True(acceptConn(l, nil, local, now))
+	}
+	assert.True(acceptConn(l, nil, remote, now))
+	assert.False(acceptConn(l, nil, remote, now))
+	assert.True(acceptConn(l, nil, local, now))
+}
+
+func TestAcceptConnBindAddr(t *testing.T) {
+	assert := assert.New(t)
+
+	// A node listening on a non-loopback address dials that address to
+	// query its own Raft state.
+	l := newRateLimiter(1)
+	now := time.Now()
+	self := net.ParseIP("10.0.0.5")
+	own := &testConn{addr: "10.0.0.5:50000"}
+	remote := &testConn{addr: "10.0.0.1:50000"}
+
+	for i := 0; i < 3; i++ {
+		assert.True(acceptConn(l, self, own, now))
+	}
+	assert.True(acceptConn(l, self, remote, now))
+	assert.False(acceptConn(l, self, remote, now))
+	assert.True(acceptConn(l, self, own, now))
+	assert.False(acceptConn(l, nil, own, now))
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/tidwall/redcon"
+)
+
+var errTooManyScans = &respError{"BUSY", "too many scans in progress, try again later"}
+
+// beginScan reserves one of the node's MaxConcurrentScans slots for a
+// command that folds over the whole keyspace, or fails with
+// errTooManyScans if they are all taken, so that a burst of scans is shed
+// rather than queued. The returned func releases the slot.
+func (kvm *Machine) beginScan(conn redcon.Conn) (func(), error) {
+	max := int32(kvm.opts.MaxConcurrentScans)
+	if conn == nil || max <= 0 {
+		return func() {}, nil
+	}
+	if atomic.AddInt32(&kvm.scans, 1) > max {
+		atomic.AddInt32(&kvm.scans, -1)
+		return nil, errTooManyScans
+	}
+	return func() { atomic.AddInt32(&kvm.scans, -1) }, nil
+}
@@ -2,16 +2,23 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
-	"encoding/binary"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prologic/bitcask"
@@ -22,83 +29,647 @@ import (
 
 const defaultTCPKeepAlive = time.Minute * 5
 
+// saveFilename is the name of the snapshot file written by SAVE and BGSAVE
+// in the data directory.
+const saveFilename = "dump.bin"
+
+// defaultSnapshotBufferSize is the size of the buffer between the snapshot's
+// gzip writer and its destination.
+const defaultSnapshotBufferSize = 1 << 16
+
+// foldCheckInterval is how many keys a fold visits between checks of the
+// command deadline.
+const foldCheckInterval = 1024
+
 var (
-	errSyntaxError = errors.New("syntax error")
+	errSyntaxError     = errors.New("syntax error")
+	errCommandTimedOut = errors.New("command timed out")
+	errSaveInProgress  = errors.New("background save already in progress")
+	errMachineClosed   = errors.New("machine is closed")
+	errRaftShutdown    = errors.New("raft is shut down")
 )
 
-func ListenAndServe(addr, join, dir, logdir string, consistency, durability finn.Level) error {
+// respError is an error replied to clients under its own Redis error
+// prefix, such as WRONGTYPE, OOM or NOAUTH, rather than finn's generic ERR.
+// Clients like go-redis match on these prefixes. Machine.Command writes
+// them for every handler.
+type respError struct {
+	prefix string
+	msg    string
+}
+
+func (e *respError) Error() string {
+	return e.prefix + " " + e.msg
+}
+
+// Options are server settings that are not covered by finn.Options.
+type Options struct {
+	// CommandTimeout bounds how long a single command may run.
+	// Zero disables the timeout.
+	CommandTimeout time.Duration
+
+	// MaxDatafileSize is the size at which bitcask rotates datafiles.
+	// Zero uses bitcask's default.
+	MaxDatafileSize int
+
+	// DisableSnapshotGzip writes snapshots uncompressed, saving CPU when
+	// values are already compressed. Restore accepts either form.
+	DisableSnapshotGzip bool
+
+	// SnapshotVarint writes snapshot lengths as varints, which makes
+	// snapshots of small keys and values much smaller but unreadable by
+	// older versions.
+	SnapshotVarint bool
+
+	// SnapshotBufferSize is the size of the write buffer used when taking
+	// snapshots. Zero uses defaultSnapshotBufferSize.
+	SnapshotBufferSize int
+
+	// NoCreateDirs makes a missing data or log directory an error instead
+	// of creating it.
+	NoCreateDirs bool
+
+	// HealthAddr is the address of the HTTP health check listener.
+	// Empty disables it.
+	HealthAddr string
+
+	// ReadTimeout bounds how long a client may take to send its next
+	// command. Zero disables it.
+	ReadTimeout time.Duration
+
+	// WriteTimeout bounds how long writing a reply to a client may take.
+	// Zero disables it.
+	WriteTimeout time.Duration
+
+	// AppendOnly enables the append-only file of applied writes.
+	AppendOnly bool
+
+	// AppendFsync is the append-only file fsync policy: always, everysec
+	// or no. Empty means everysec.
+	AppendFsync string
+
+	// AOFRotateSize is the size in bytes at which the append-only file is
+	// rotated. Zero disables rotation.
+	AOFRotateSize int64
+
+	// LogUnknownCommands logs unknown commands as warnings rather than
+	// at debug level.
+	LogUnknownCommands bool
+
+	// ProtectedMode refuses commands from clients that do not connect
+	// from a loopback address.
+	ProtectedMode bool
+
+	// JoinRetries is how many more times to try the join addresses when
+	// none is reachable.
+	JoinRetries int
+
+	// JoinRetryInterval is the wait before the first join retry. It
+	// doubles with every retry.
+	JoinRetryInterval time.Duration
+
+	// AcceptRateLimit is the maximum number of connections accepted per
+	// second, with bursts of as many. Raft peers connect on the same port,
+	// so it must leave room for them. Zero disables it.
+	AcceptRateLimit int
+
+	// WaitForLeaderTimeout is how long a client command that needs the
+	// leader waits for one to be elected, when the cluster has none,
+	// before failing. Zero fails immediately.
+	WaitForLeaderTimeout time.Duration
+
+	// MaxConcurrentScans is the number of KEYS, GETPATTERN, EXPORT and
+	// INFO values-histogram commands the node serves at once; more are
+	// refused with a BUSY error. Zero means no limit.
+	MaxConcurrentScans int
+
+	// KeysSingleFold makes KEYS collect its reply in a single fold instead
+	// of counting first and streaming. It is faster on small keyspaces but
+	// buffers the whole reply in memory.
+	KeysSingleFold bool
+}
+
+// ensureDir checks that dir exists and is a directory, creating it first if
+// create is set.
+func ensureDir(dir string, create bool) error {
+	if create {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("could not create directory %q: %v", dir, err)
+		}
+		return nil
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("directory %q does not exist", dir)
+		}
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%q is not a directory", dir)
+	}
+	return nil
+}
+
+// validateAddr checks that addr is a host:port pair with a non-empty host
+// and a valid port, and that the host resolves. It returns the resolved
+// address.
+func validateAddr(addr string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		return nil, errors.New("missing host")
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return nil, errors.New("invalid port " + strconv.Quote(port))
+	}
+	return net.ResolveTCPAddr("tcp", addr)
+}
+
+// parseLevel parses a consistency or durability level name.
+func parseLevel(s string) (finn.Level, bool) {
+	switch strings.ToLower(s) {
+	case "low":
+		return finn.Low, true
+	case "medium", "med":
+		return finn.Medium, true
+	case "high":
+		return finn.High, true
+	}
+	return finn.Medium, false
+}
+
+// levelName returns the flag value naming level.
+func levelName(level finn.Level) string {
+	switch level {
+	case finn.Low:
+		return "low"
+	case finn.High:
+		return "high"
+	}
+	return "medium"
+}
+
+// logConfig logs the effective configuration at startup.
+func logConfig(addr, join, dir, logdir string, consistency, durability finn.Level, opts Options) {
+	log.Infof("bitraft %s starting", FullVersion())
+	log.Infof("bind address: %s", addr)
+	log.Infof("data directory: %s", dir)
+	log.Infof("log directory: %s", logdir)
+	log.Infof("consistency: %s, durability: %s", levelName(consistency), levelName(durability))
+	log.Infof("max datafile size: %d bytes", opts.MaxDatafileSize)
+	if opts.ProtectedMode {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+				log.Warningf("protected mode is on: commands from other hosts will be refused (use --protected-mode=false to allow them)")
+			}
+		}
+	}
+	if join != "" {
+		log.Infof("joining cluster via %s", join)
+	} else {
+		log.Infof("not joining: bootstrapping a new cluster or resuming existing state")
+	}
+}
+
+func ListenAndServe(addr, join, dir, logdir string, consistency, durability finn.Level, options *Options) error {
+	m, err := NewMachine(dir, addr, options)
+	if err != nil {
+		return err
+	}
+	m.consistency = consistency
+	m.setDurability(durability)
+	m.readConsistency = int32(consistency)
+	if m.opts.AcceptRateLimit > 0 {
+		m.limiter = newRateLimiter(m.opts.AcceptRateLimit)
+	}
+	if tcp, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		m.self = tcp.IP
+	}
+	m.peers = newPeerHosts(logdir, splitJoin(join))
 	opts := finn.Options{
 		Backend:     finn.FastLog,
 		Consistency: consistency,
 		Durability:  durability,
-		ConnAccept: func(conn redcon.Conn) bool {
-			if tcp, ok := conn.NetConn().(*net.TCPConn); ok {
-				if err := tcp.SetKeepAlive(true); err != nil {
-					log.Warningf("could not set keepalive: %s",
-						tcp.RemoteAddr().String())
-				} else {
-					err := tcp.SetKeepAlivePeriod(defaultTCPKeepAlive)
-					if err != nil {
-						log.Warningf("could not set keepalive period: %s",
-							tcp.RemoteAddr().String())
-					}
-				}
-			}
-			return true
-		},
+		ConnAccept:  m.connAccept,
 	}
-	m, err := NewMachine(dir, addr)
-	if err != nil {
+	logConfig(addr, join, dir, logdir, consistency, durability, m.opts)
+	if err := ensureDir(logdir, !m.opts.NoCreateDirs); err != nil {
 		return err
 	}
+	if addrs := splitJoin(join); len(addrs) > 0 {
+		join = waitJoinAddr(addrs, m.opts.JoinRetries, m.opts.JoinRetryInterval)
+		if join == "" {
+			// A node with existing Raft state does not need to join, so
+			// let finn decide whether this is fatal.
+			log.Warningf("no join address is reachable after %d attempts", m.opts.JoinRetries+1)
+			join = addrs[0]
+		}
+	}
 	n, err := finn.Open(logdir, addr, join, m, &opts)
 	if err != nil {
+		m.Close()
 		return err
 	}
-	defer n.Close()
 
-	select {
-	// blocking, there's no way out
+	if m.opts.HealthAddr != "" {
+		go func() {
+			if err := serveHealth(m.opts.HealthAddr, m); err != nil {
+				log.Warningf("health check listener failed: %v", err)
+			}
+		}()
 	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	log.Infof("received %s, shutting down", <-sig)
+
+	n.Close()
+	return m.Close()
 }
 
 type Machine struct {
 	mu     sync.RWMutex
 	dir    string
 	db     *bitcask.Bitcask
-	dbPath string
+	lock   *lockFile
+	aof    *aof
 	addr   string
+	opts   Options
 	closed bool
+
+	consistency finn.Level // the level finn applies reads at
+	durability  finn.Level // the level finn applies writes at
+
+	readConsistency int32 // atomic: finn.Level of reads, set by CONFIG SET
+
+	syncDone chan struct{} // closed to stop the medium durability sync loop
+
+	limiter *rateLimiter // accept rate limit, nil if disabled
+	self    net.IP       // the IP the node listens on, exempt from limiter
+	peers   *peerHosts   // Raft peers, exempt from the read timeout
+
+	ops      opRegistry
+	feed     changefeed
+	monitors monitors
+	stats    commandStats
+	started  time.Time
+
+	diskFull int32  // atomic: 1 while writes are rejected for lack of space
+	saving   int32  // atomic: 1 while SAVE or BGSAVE is running
+	scans    int32  // atomic: scans in progress, see beginScan
+	lastSave int64  // atomic: unix time of the last successful save
+	hits     int64  // atomic: reads of existing keys
+	misses   int64  // atomic: reads of missing keys
+	index    uint64 // atomic: write index of the last applied write, see recordWrite
+
+	// mtime is the time, in unix nanoseconds, the write being applied from
+	// the Raft log was stamped with by the leader, or 0. It is only used
+	// while applying the log, which finn does one command at a time.
+	mtime int64
 }
 
-func NewMachine(dir, addr string) (*Machine, error) {
+func NewMachine(dir, addr string, options *Options) (*Machine, error) {
 	kvm := &Machine{
 		dir:  dir,
 		addr: addr,
 	}
+	if options != nil {
+		kvm.opts = *options
+	}
+	kvm.started = time.Now()
+	kvm.lastSave = kvm.started.Unix()
+	if err := ensureDir(dir, !kvm.opts.NoCreateDirs); err != nil {
+		return nil, err
+	}
 	var err error
-	kvm.dbPath = filepath.Join(dir, "node.db")
-	kvm.db, err = bitcask.Open(kvm.dir)
+	kvm.lock, err = acquireLock(dir)
+	if err != nil {
+		return nil, err
+	}
+	kvm.db, err = kvm.openDB()
 	if err != nil {
+		kvm.lock.Release()
 		return nil, err
 	}
+	if kvm.opts.AppendOnly {
+		fsync := kvm.opts.AppendFsync
+		if fsync == "" {
+			fsync = aofFsyncEverysec
+		}
+		path := filepath.Join(dir, defaultAOFFilename)
+		kvm.aof, err = openAOF(path, fsync, kvm.opts.AOFRotateSize)
+		if err != nil {
+			kvm.db.Close()
+			kvm.lock.Release()
+			return nil, err
+		}
+	}
 	return kvm, nil
 }
 
+// openDB opens the bitcask database in the data directory.
+func (kvm *Machine) openDB() (*bitcask.Bitcask, error) {
+	var options []bitcask.Option
+	if kvm.opts.MaxDatafileSize > 0 {
+		options = append(options, bitcask.WithMaxDatafileSize(kvm.opts.MaxDatafileSize))
+	}
+	return bitcask.Open(kvm.dir, options...)
+}
+
+// commandContext returns a context that expires once the configured
+// command timeout has elapsed.
+func (kvm *Machine) commandContext() (context.Context, context.CancelFunc) {
+	if kvm.opts.CommandTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), kvm.opts.CommandTimeout)
+}
+
+// readLevel strips an optional trailing "CONSISTENCY level" modifier from
+// the arguments of a read command. It returns the remaining arguments and
+// the requested level, or the default level if there is no modifier.
+func (kvm *Machine) readLevel(args [][]byte) ([][]byte, finn.Level, error) {
+	if len(args) < 3 || strings.ToLower(string(args[len(args)-2])) != "consistency" {
+		return args, kvm.defaultLevel(), nil
+	}
+	level, ok := parseLevel(string(args[len(args)-1]))
+	if !ok {
+		return nil, 0, errSyntaxError
+	}
+	return args[:len(args)-2], level, nil
+}
+
+// applyRead applies a read command at the given consistency level. finn
+// applies every read at the server's level, so a Low read is served locally
+// and a read stronger than the server's level is sent through the Raft log
+// with a no-op mutate, which is at least as strong as High. Reads on a
+// READONLY connection are always served locally.
+//
+// The level of a read is node-local, as CONFIG SET consistency is not
+// replicated, so a logged read records its level explicitly. Reads change
+// nothing, so replaying one from the log is a no-op.
+func (kvm *Machine) applyRead(
+	m finn.Applier, conn redcon.Conn, cmd redcon.Command, level finn.Level,
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if conn == nil {
+		return nil, nil
+	}
+	if st := stateOf(conn); st != nil && st.readonly {
+		level = finn.Low
+	}
+	if level != finn.Low {
+		cmd = withLevel(cmd, level)
+	}
+	switch {
+	case level == finn.Low:
+		return respond(nil)
+	case level > kvm.consistency:
+		return m.Apply(conn, cmd,
+			func() (interface{}, error) {
+				return nil, nil
+			},
+			respond,
+		)
+	}
+	return m.Apply(conn, cmd, nil, respond)
+}
+
+// withLevel returns a read command with its CONSISTENCY modifier, if any,
+// replaced by one naming level.
+func withLevel(cmd redcon.Command, level finn.Level) redcon.Command {
+	args := cmd.Args
+	if len(args) >= 3 && strings.ToLower(string(args[len(args)-2])) == "consistency" {
+		args = args[:len(args)-2]
+	}
+	return buildCommand(append(args[:len(args):len(args)],
+		[]byte("CONSISTENCY"), []byte(levelName(level)))...)
+}
+
+// fold calls fn for every key in the database but the reserved ones,
+// giving up with errCommandTimedOut or errOperationCanceled once ctx is
+// done. The caller must hold kvm.mu.
+func (kvm *Machine) fold(ctx context.Context, fn func(key string) error) error {
+	return kvm.db.Fold(withContext(ctx, skipReserved(fn)))
+}
+
+// foldPrefix is fold for the keys starting with prefix. Bitcask indexes
+// keys in a trie, so only the matching keys are visited. The caller must
+// hold kvm.mu.
+func (kvm *Machine) foldPrefix(ctx context.Context, prefix string, fn func(key string) error) error {
+	if prefix == "" {
+		return kvm.fold(ctx, fn)
+	}
+	return kvm.db.Scan(prefix, withContext(ctx, skipReserved(fn)))
+}
+
+// skipReserved wraps fn to skip the reserved keys.
+func skipReserved(fn func(key string) error) func(key string) error {
+	return func(key string) error {
+		if isReserved(key) {
+			return nil
+		}
+		return fn(key)
+	}
+}
+
+// withContext wraps fn to fail once ctx is done, checking it every
+// foldCheckInterval keys.
+func withContext(ctx context.Context, fn func(key string) error) func(key string) error {
+	var n int
+	return func(key string) error {
+		if n%foldCheckInterval == 0 && ctx.Err() != nil {
+			return ctxErr(ctx)
+		}
+		n++
+		return fn(key)
+	}
+}
+
+// abortReply closes conn after a failure part way through a streamed reply,
+// since the reply already written cannot be completed or followed by an
+// error.
+func abortReply(conn redcon.Conn, err error) {
+	log.Warningf("aborting reply to %s: %v", conn.RemoteAddr(), err)
+	conn.Close()
+}
+
 func (kvm *Machine) Close() error {
 	kvm.mu.Lock()
 	defer kvm.mu.Unlock()
+	if kvm.closed {
+		return nil
+	}
+	if kvm.syncDone != nil {
+		close(kvm.syncDone)
+	}
 	kvm.db.Close()
+	if kvm.aof != nil {
+		if err := kvm.aof.Close(); err != nil {
+			log.Warningf("could not close append-only file: %v", err)
+		}
+	}
 	kvm.closed = true
-	return nil
+	return kvm.lock.Release()
+}
+
+// recordWrite numbers an applied write, stamps the written keys with its
+// index and time, publishes it to CHANGEFEED subscribers and records it in
+// the append-only file, if enabled. The caller must hold kvm.mu for
+// writing. The write has already been applied by then, so failures are
+// only logged.
+//
+// Writes re-applied from the Raft log at startup get the same numbers as
+// before the restart: the count restarts from 0, or from the snapshot
+// restored first, and the same writes are applied in the same order.
+func (kvm *Machine) recordWrite(args [][]byte) {
+	index := atomic.AddUint64(&kvm.index, 1)
+	kvm.stampWrite(index, kvm.mtime, args)
+	kvm.feed.publish(index, args)
+	if kvm.aof == nil {
+		return
+	}
+	if err := kvm.aof.Append(index, args); err != nil {
+		log.Warningf("could not write to append-only file: %v", err)
+	}
+}
+
+// connAccept is finn's ConnAccept hook. It applies the accept rate limit,
+// enables TCP keepalives and starts the read timeout, so that a client
+// that sends nothing, or only part of a command, is cut off. Raft peers are
+// exempt: their connections are served by finn and never reach the
+// Machine, so their deadline would never be refreshed.
+func (kvm *Machine) connAccept(conn redcon.Conn) bool {
+	now := time.Now()
+	if !acceptConn(kvm.limiter, kvm.self, conn, now) {
+		// Write directly: redcon only flushes replies to commands.
+		conn.NetConn().Write([]byte("-ERR max connection rate exceeded\r\n"))
+		return false
+	}
+	if tcp, ok := conn.NetConn().(*net.TCPConn); ok {
+		if err := tcp.SetKeepAlive(true); err != nil {
+			log.Warningf("could not set keepalive: %s",
+				tcp.RemoteAddr().String())
+		} else {
+			err := tcp.SetKeepAlivePeriod(defaultTCPKeepAlive)
+			if err != nil {
+				log.Warningf("could not set keepalive period: %s",
+					tcp.RemoteAddr().String())
+			}
+		}
+	}
+	if kvm.opts.ReadTimeout > 0 && !kvm.peers.contains(conn) {
+		conn.NetConn().SetReadDeadline(now.Add(kvm.opts.ReadTimeout))
+	}
+	return true
+}
+
+// setDeadlines bounds the time to flush the reply to the current command
+// and to read the next one, refreshing the read deadline set by
+// connAccept.
+func (kvm *Machine) setDeadlines(conn redcon.Conn) {
+	if conn == nil || (kvm.opts.ReadTimeout <= 0 && kvm.opts.WriteTimeout <= 0) {
+		return
+	}
+	if st := stateOf(conn); st != nil && st.detached {
+		return
+	}
+	nc := conn.NetConn()
+	if nc == nil {
+		return
+	}
+	now := time.Now()
+	if kvm.opts.ReadTimeout > 0 {
+		nc.SetReadDeadline(now.Add(kvm.opts.ReadTimeout))
+	}
+	if kvm.opts.WriteTimeout > 0 {
+		nc.SetWriteDeadline(now.Add(kvm.opts.WriteTimeout))
+	}
 }
 
 func (kvm *Machine) Command(
 	m finn.Applier, conn redcon.Conn, cmd redcon.Command,
+) (interface{}, error) {
+	defer kvm.setDeadlines(conn)
+	if conn == nil {
+		// Writes are logged stamped with a time, see stampApplier.
+		cmd, kvm.mtime = unstamp(cmd)
+		defer func() { kvm.mtime = 0 }()
+	}
+	// finn handles Raft traffic between nodes itself, so this only
+	// refuses clients.
+	if conn != nil && kvm.opts.ProtectedMode && !isLoopback(conn) {
+		conn.WriteError(errProtectedMode.Error())
+		return nil, nil
+	}
+	if conn != nil && atomic.LoadInt32(&kvm.diskFull) != 0 &&
+		writeCommands[strings.ToLower(string(cmd.Args[0]))] {
+		conn.WriteError(errDiskFull.Error())
+		return nil, nil
+	}
+	st := stateOf(conn)
+	if st != nil {
+		if st.readonly && writeCommands[strings.ToLower(string(cmd.Args[0]))] {
+			conn.WriteError(errReadonlyConn.Error())
+			return nil, nil
+		}
+		if st.prefix != "" {
+			cmd = prefixKeys(cmd, st.prefix)
+		}
+	}
+	if conn != nil && hasReservedKey(cmd) {
+		conn.WriteError(errReservedKey.Error())
+		return nil, nil
+	}
+	if st != nil && st.compress > 0 {
+		conn = &compressConn{conn, st.compress}
+	}
+	if conn != nil && writeCommands[strings.ToLower(string(cmd.Args[0]))] {
+		m = stampApplier{m, time.Now}
+	}
+	if conn != nil && kvm.monitors.active() {
+		kvm.monitors.publish(monitorLine(time.Now(), conn.RemoteAddr(), cmd.Args))
+	}
+	start := time.Now()
+	res, err := kvm.dispatch(m, conn, cmd)
+	if conn != nil && kvm.opts.WaitForLeaderTimeout > 0 && isLeaderUnknown(err) {
+		// finn refuses the command before it reaches the Raft log, so it
+		// is safe to retry once a leader is elected.
+		ctx, cancel := context.WithTimeout(context.Background(), kvm.opts.WaitForLeaderTimeout)
+		if waitForLeader(ctx, kvm.addr) {
+			res, err = kvm.dispatch(m, conn, cmd)
+		}
+		cancel()
+	}
+	if conn != nil && err != finn.ErrUnknownCommand {
+		kvm.stats.record(strings.ToLower(string(cmd.Args[0])), time.Since(start))
+	}
+	if err == finn.ErrUnknownCommand && conn != nil {
+		conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
+		return nil, nil
+	}
+	if re, ok := err.(*respError); ok && conn != nil {
+		conn.WriteError(re.Error())
+		return nil, nil
+	}
+	return res, err
+}
+
+// dispatch routes cmd to its handler.
+func (kvm *Machine) dispatch(
+	m finn.Applier, conn redcon.Conn, cmd redcon.Command,
 ) (interface{}, error) {
 	switch strings.ToLower(string(cmd.Args[0])) {
 	default:
-		log.Warningf("unknown command: %s\n", cmd.Args[0])
+		// Clients probing for optional commands make this noisy.
+		if kvm.opts.LogUnknownCommands {
+			log.Warningf("unknown command: %s", cmd.Args[0])
+		} else {
+			log.Debugf("unknown command: %s", cmd.Args[0])
+		}
 		return nil, finn.ErrUnknownCommand
 	case "echo":
 		return kvm.cmdEcho(m, conn, cmd)
@@ -106,16 +677,67 @@ func (kvm *Machine) Command(
 		return kvm.cmdSet(m, conn, cmd)
 	case "get":
 		return kvm.cmdGet(m, conn, cmd)
+	case "localget":
+		return kvm.cmdLocalget(m, conn, cmd)
+	case "mget":
+		return kvm.cmdMget(m, conn, cmd)
 	case "del":
 		return kvm.cmdDel(m, conn, cmd)
+	case "incrbyfloat":
+		return kvm.cmdIncrbyfloat(m, conn, cmd)
 	case "keys":
 		return kvm.cmdKeys(m, conn, cmd)
+	case "getpattern":
+		return kvm.cmdGetpattern(m, conn, cmd)
+	case "export":
+		return kvm.cmdExport(m, conn, cmd)
+	case "import":
+		return kvm.cmdImport(m, conn, cmd)
 	case "flushdb":
 		return kvm.cmdFlushdb(m, conn, cmd)
+	case "save":
+		return kvm.cmdSave(m, conn, cmd)
+	case "bgsave":
+		return kvm.cmdBgsave(m, conn, cmd)
+	case "lastsave":
+		return kvm.cmdLastsave(m, conn, cmd)
+	case "fsync":
+		return kvm.cmdFsync(m, conn, cmd)
+	case "reset":
+		return kvm.cmdReset(m, conn, cmd)
+	case "useprefix":
+		return kvm.cmdUseprefix(m, conn, cmd)
+	case "client":
+		return kvm.cmdClient(m, conn, cmd)
+	case "readonly":
+		return kvm.cmdReadonly(m, conn, cmd)
+	case "readwrite":
+		return kvm.cmdReadwrite(m, conn, cmd)
+	case "reindex":
+		return kvm.cmdReindex(m, conn, cmd)
+	case "raft":
+		return kvm.cmdRaft(m, conn, cmd)
+	case "config":
+		return kvm.cmdConfig(m, conn, cmd)
+	case "changefeed":
+		return kvm.cmdChangefeed(m, conn, cmd)
+	case "monitor":
+		return kvm.cmdMonitor(m, conn, cmd)
+	case "ops":
+		return kvm.cmdOps(m, conn, cmd)
+	case "info":
+		return kvm.cmdInfo(m, conn, cmd)
+	case "debug":
+		return kvm.cmdDebug(m, conn, cmd)
+	case "object":
+		return kvm.cmdObject(m, conn, cmd)
+	case "migrate":
+		return kvm.cmdMigrate(m, conn, cmd)
 	case "shutdown":
 		log.Warningf("shutting down")
 		conn.WriteString("OK")
 		conn.Close()
+		kvm.Close()
 		os.Exit(0)
 		return nil, nil
 	}
@@ -124,92 +746,136 @@ func (kvm *Machine) Command(
 func (kvm *Machine) Restore(rd io.Reader) error {
 	kvm.mu.Lock()
 	defer kvm.mu.Unlock()
-	var err error
-	if err := kvm.db.Close(); err != nil {
+	return kvm.restore(rd)
+}
+
+// restore is Restore. The caller must hold kvm.mu for writing.
+//
+// The snapshot is first copied to a temporary file and read through to the
+// end, so that a truncated or corrupt snapshot is rejected before the
+// database is touched. Only then are the existing keys replaced.
+func (kvm *Machine) restore(rd io.Reader) error {
+	f, err := ioutil.TempFile(kvm.dir, "restore")
+	if err != nil {
 		return err
 	}
-	if err := os.RemoveAll(kvm.dbPath); err != nil {
+	defer os.Remove(f.Name())
+	defer f.Close()
+	// Snapshots written before write indexes were numbered have no index
+	// record, and count from 0.
+	var index uint64
+	err = readSnapshot(io.TeeReader(rd, f), func(key, value []byte) error {
+		if string(key) != indexRecordKey {
+			return nil
+		}
+		var err error
+		index, err = decodeIndex(value)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("invalid snapshot, keeping current data: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
-	kvm.db = nil
-	kvm.db, err = bitcask.Open(kvm.dir)
+
+	var keys []string
+	err = kvm.db.Fold(func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	num := make([]byte, 8)
-	gzr, err := gzip.NewReader(rd)
+	for _, key := range keys {
+		if err := kvm.db.Delete(key); err != nil {
+			return err
+		}
+	}
+	atomic.StoreUint64(&kvm.index, index)
+	kvm.feed.reset(index)
+
+	load := func(record func(args [][]byte)) error {
+		return readSnapshot(f, func(key, value []byte) error {
+			if string(key) == indexRecordKey {
+				return nil
+			}
+			if err := kvm.db.Put(string(key), value); err != nil {
+				return err
+			}
+			if !isReserved(string(key)) {
+				record([][]byte{[]byte("SET"), key, value})
+			}
+			return nil
+		})
+	}
+	// The append-only file already has the writes up to its own index, so
+	// it is only rewritten from a snapshot that is ahead of it.
+	if kvm.aof != nil && kvm.aof.NeedsRewrite(index) {
+		return kvm.aof.Rewrite(index, load)
+	}
+	return load(func([][]byte) {})
+}
+
+// readSnapshot calls fn, if not nil, for every record of the snapshot in
+// rd, and checks that the snapshot is complete.
+func readSnapshot(rd io.Reader, fn func(key, value []byte) error) error {
+	sr, err := newSnapshotReader(rd)
 	if err != nil {
 		return err
 	}
-	r := bufio.NewReader(gzr)
 	for {
-		if _, err := io.ReadFull(r, num); err != nil {
+		key, value, err := sr.Next()
+		if err != nil {
 			if err == io.EOF {
 				break
 			}
 			return err
 		}
-		key := make([]byte, int(binary.LittleEndian.Uint64(num)))
-		if _, err := io.ReadFull(r, key); err != nil {
-			return err
-		}
-		if _, err := io.ReadFull(r, num); err != nil {
-			return err
-		}
-		value := make([]byte, int(binary.LittleEndian.Uint64(num)))
-		if _, err := io.ReadFull(r, value); err != nil {
-			return err
+		if fn != nil {
+			if err := fn(key, value); err != nil {
+				return err
+			}
 		}
-		kvm.db.Put(string(key), value)
 	}
-	return gzr.Close()
+	return sr.Close()
 }
 
 // WriteRedisCommandsFromSnapshot will read a snapshot and write all the
 // Redis SET commands needed to rebuild the entire database.
-// The commands are written to wr.
+// The commands are written to wr. A snapshotPath of "-" reads the snapshot
+// from standard input.
 func WriteRedisCommandsFromSnapshot(wr io.Writer, snapshotPath string) error {
+	if snapshotPath == "-" {
+		return WriteRedisCommandsFromSnapshotReader(wr, os.Stdin)
+	}
 	f, err := os.Open(snapshotPath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	return WriteRedisCommandsFromSnapshotReader(wr, f)
+}
+
+// WriteRedisCommandsFromSnapshotReader is like WriteRedisCommandsFromSnapshot
+// but reads the snapshot from rd.
+func WriteRedisCommandsFromSnapshotReader(wr io.Writer, rd io.Reader) error {
 	var cmd []byte
-	num := make([]byte, 8)
-	var gzclosed bool
-	gzr, err := gzip.NewReader(f)
+	sr, err := newSnapshotReader(rd)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if !gzclosed {
-			gzr.Close()
-		}
-	}()
-	r := bufio.NewReader(gzr)
 	for {
-		if _, err := io.ReadFull(r, num); err != nil {
+		key, value, err := sr.Next()
+		if err != nil {
 			if err == io.EOF {
 				break
 			}
 			return err
 		}
-		key := make([]byte, int(binary.LittleEndian.Uint64(num)))
-		if _, err := io.ReadFull(r, key); err != nil {
-			return err
-		}
-		if _, err := io.ReadFull(r, num); err != nil {
-			return err
-		}
-		value := make([]byte, int(binary.LittleEndian.Uint64(num)))
-		if _, err := io.ReadFull(r, value); err != nil {
-			return err
-		}
-		if len(key) == 0 || key[0] != 'k' {
-			// do not accept keys that do not start with 'k'
+		if isReserved(string(key)) {
 			continue
 		}
-		key = key[1:]
 		cmd = cmd[:0]
 		cmd = append(cmd, "*3\r\n$3\r\nSET\r\n$"...)
 		cmd = strconv.AppendInt(cmd, int64(len(key)), 10)
@@ -224,56 +890,260 @@ func WriteRedisCommandsFromSnapshot(wr io.Writer, snapshotPath string) error {
 			return err
 		}
 	}
-	err = gzr.Close()
-	gzclosed = true
-	return err
+	return sr.Close()
 }
 
 func (kvm *Machine) Snapshot(wr io.Writer) error {
+	return kvm.snapshot(context.Background(), wr)
+}
+
+// snapshot is Snapshot, stopping early once ctx is done.
+func (kvm *Machine) snapshot(ctx context.Context, wr io.Writer) error {
 	kvm.mu.RLock()
 	defer kvm.mu.RUnlock()
-	gzw := gzip.NewWriter(wr)
+	return kvm.writeSnapshot(ctx, wr)
+}
+
+// writeSnapshot is snapshot. The caller must hold kvm.mu.
+func (kvm *Machine) writeSnapshot(ctx context.Context, wr io.Writer) error {
+	size := kvm.opts.SnapshotBufferSize
+	if size <= 0 {
+		size = defaultSnapshotBufferSize
+	}
+	bw := bufio.NewWriterSize(wr, size)
+	var w io.Writer = bw
+	var gzw *gzip.Writer
+	if !kvm.opts.DisableSnapshotGzip {
+		gzw = gzip.NewWriter(bw)
+		w = gzw
+	}
+	// Compressed snapshots stay headerless so that older nodes can
+	// restore them, unless they use varint lengths.
+	var version byte = snapshotV1
+	switch {
+	case kvm.opts.SnapshotVarint:
+		version = snapshotV2
+	case gzw != nil:
+		version = snapshotOriginal
+	}
+	sw, err := newSnapshotWriter(w, version)
+	if err != nil {
+		return err
+	}
+	if err := sw.Write([]byte(indexRecordKey), encodeIndex(kvm.writeIndex())); err != nil {
+		return err
+	}
 
-	err := kvm.db.Fold(func(key string) error {
-		var buf []byte
+	// The reserved keys are part of the state, so they are included.
+	err = kvm.db.Fold(withContext(ctx, func(key string) error {
 		value, err := kvm.db.Get(key)
 		if err != nil {
 			return err
 		}
+		return sw.Write([]byte(key), value)
+	}))
+	if err != nil {
+		return err
+	}
 
-		num := make([]byte, 8)
-		binary.LittleEndian.PutUint64(num, uint64(len(key)))
-		buf = append(buf, num...)
-		buf = append(buf, key...)
-		binary.LittleEndian.PutUint64(num, uint64(len(value)))
-		buf = append(buf, num...)
-		buf = append(buf, value...)
-		if _, err := gzw.Write(buf); err != nil {
+	if gzw != nil {
+		if err := gzw.Close(); err != nil {
 			return err
 		}
-		return nil
-	})
+	}
+	return bw.Flush()
+}
+
+// save writes a snapshot of the local database to saveFilename in the data
+// directory, unless a save is already running.
+func (kvm *Machine) save(name string) error {
+	if !atomic.CompareAndSwapInt32(&kvm.saving, 0, 1) {
+		return errSaveInProgress
+	}
+	return kvm.saveLocked(name)
+}
+
+// saveLocked is save for a caller that has set kvm.saving, which it clears.
+// The snapshot is written to a temporary file first so a failed save never
+// clobbers the previous one. It is listed by OPS under name.
+func (kvm *Machine) saveLocked(name string) error {
+	defer atomic.StoreInt32(&kvm.saving, 0)
+	ctx, done := kvm.trackOp(context.Background(), name)
+	defer done()
+
+	f, err := ioutil.TempFile(kvm.dir, saveFilename+".tmp")
 	if err != nil {
 		return err
 	}
+	if err := kvm.snapshot(ctx, f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(kvm.dir, saveFilename)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	atomic.StoreInt64(&kvm.lastSave, time.Now().Unix())
+	return nil
+}
 
-	return gzw.Close()
+func (kvm *Machine) cmdSave(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if err := kvm.save("save"); err != nil {
+		return nil, err
+	}
+	conn.WriteString("OK")
+	return nil, nil
 }
 
+func (kvm *Machine) cmdBgsave(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	// The flag is taken before replying, so that a second BGSAVE fails
+	// rather than starting a save that fails in the background.
+	if !atomic.CompareAndSwapInt32(&kvm.saving, 0, 1) {
+		return nil, errSaveInProgress
+	}
+	go func() {
+		if err := kvm.saveLocked("bgsave"); err != nil {
+			log.Warningf("background save failed: %v", err)
+			return
+		}
+		log.Infof("background save completed")
+	}()
+	conn.WriteString("Background saving started")
+	return nil, nil
+}
+
+// cmdFsync syncs the local node's database to disk. It is node-local
+// housekeeping and is not replicated.
+func (kvm *Machine) cmdFsync(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	kvm.mu.Lock()
+	defer kvm.mu.Unlock()
+	if err := kvm.db.Sync(); err != nil {
+		return nil, err
+	}
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+func (kvm *Machine) cmdLastsave(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	conn.WriteInt(int(atomic.LoadInt64(&kvm.lastSave)))
+	return nil, nil
+}
+
+// cmdReindex closes and reopens the local database, which makes bitcask
+// rebuild its keydir from the datafiles on disk, and replies with the
+// number of keys indexed. Use it after the datafiles were replaced
+// underneath a running node. It is node-local and not replicated.
+func (kvm *Machine) cmdReindex(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	kvm.mu.Lock()
+	defer kvm.mu.Unlock()
+	if err := kvm.db.Close(); err != nil {
+		return nil, err
+	}
+	db, err := kvm.openDB()
+	if err != nil {
+		log.Errorf("could not reopen database after reindex: %v", err)
+		return nil, err
+	}
+	kvm.db = db
+	var n int
+	err = kvm.db.Fold(skipReserved(func(key string) error {
+		n++
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("reindexed %d keys", n)
+	conn.WriteInt(n)
+	return nil, nil
+}
+
+// cmdReset returns the connection to a clean state by dropping everything
+// kept in its context.
+func (kvm *Machine) cmdReset(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	conn.SetContext(nil)
+	conn.WriteString("RESET")
+	return nil, nil
+}
+
+// cmdSet sets a key. With GET it replies with the previous value, or null,
+// instead of OK.
 func (kvm *Machine) cmdSet(
 	m finn.Applier, conn redcon.Conn, cmd redcon.Command,
 ) (interface{}, error) {
-	if len(cmd.Args) != 3 {
+	if len(cmd.Args) < 3 {
 		return nil, finn.ErrWrongNumberOfArguments
 	}
+	var get bool
+	for _, arg := range cmd.Args[3:] {
+		switch strings.ToLower(string(arg)) {
+		default:
+			return nil, errSyntaxError
+		case "get":
+			get = true
+		}
+	}
 	return m.Apply(conn, cmd,
 		func() (interface{}, error) {
 			kvm.mu.Lock()
 			defer kvm.mu.Unlock()
-			return nil, kvm.db.Put(string(cmd.Args[1]), cmd.Args[2])
+			key := string(cmd.Args[1])
+			var old interface{}
+			if get {
+				value, err := kvm.db.Get(key)
+				if err == nil {
+					old = value
+				} else if err != bitcask.ErrKeyNotFound {
+					return nil, err
+				}
+			}
+			if err := kvm.db.Put(key, cmd.Args[2]); err != nil {
+				return nil, kvm.writeErr(err)
+			}
+			if err := kvm.syncWrite(); err != nil {
+				return nil, kvm.writeErr(err)
+			}
+			kvm.recordWrite(cmd.Args[:3])
+			return old, nil
 		},
 		func(v interface{}) (interface{}, error) {
-			conn.WriteString("OK")
+			if !get {
+				conn.WriteString("OK")
+				return nil, nil
+			}
+			if old, ok := v.([]byte); ok {
+				conn.WriteBulk(old)
+			} else {
+				conn.WriteNull()
+			}
 			return nil, nil
 		},
 	)
@@ -288,29 +1158,118 @@ func (kvm *Machine) cmdEcho(m finn.Applier, conn redcon.Conn, cmd redcon.Command
 }
 
 func (kvm *Machine) cmdGet(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	args, level, err := kvm.readLevel(cmd.Args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(args[1])
+	return kvm.applyRead(m, conn, cmd, level,
+		func(interface{}) (interface{}, error) {
+			return kvm.replyGet(conn, key)
+		},
+	)
+}
+
+// cmdLocalget reads a key from the local node's applied state without
+// going through the leader, whatever the configured consistency. On a
+// follower the value may be stale.
+func (kvm *Machine) cmdLocalget(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
 	if len(cmd.Args) != 2 {
 		return nil, finn.ErrWrongNumberOfArguments
 	}
-	key := string(cmd.Args[1])
-	return m.Apply(conn, cmd, nil,
+	return kvm.replyGet(conn, string(cmd.Args[1]))
+}
+
+// exists reports whether key is present. The caller must hold kvm.mu.
+func (kvm *Machine) exists(key string) (bool, error) {
+	if _, err := kvm.db.Get(key); err != nil {
+		if err == bitcask.ErrKeyNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// replyGet writes the value of key, or null if it does not exist, to conn.
+func (kvm *Machine) replyGet(conn redcon.Conn, key string) (interface{}, error) {
+	kvm.mu.RLock()
+	defer kvm.mu.RUnlock()
+	value, err := kvm.db.Get(key)
+	if err != nil {
+		if err == bitcask.ErrKeyNotFound {
+			atomic.AddInt64(&kvm.misses, 1)
+			conn.WriteNull()
+			return nil, nil
+		}
+		return nil, err
+	}
+	atomic.AddInt64(&kvm.hits, 1)
+	conn.WriteBulk(value)
+	return nil, nil
+}
+
+// cmdMget replies with the values of several keys, null for missing ones,
+// in the order they were asked for. The keys are read one after another:
+// Bitcask reads a datafile by seeking its shared handle under the
+// datafile's lock, so reading them concurrently would not overlap.
+func (kvm *Machine) cmdMget(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	args, level, err := kvm.readLevel(cmd.Args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return kvm.applyRead(m, conn, cmd, level,
 		func(interface{}) (interface{}, error) {
-			kvm.mu.RLock()
-			defer kvm.mu.RUnlock()
-			value, err := kvm.db.Get(key)
+			values, err := kvm.mget(args[1:])
 			if err != nil {
-				if err == bitcask.ErrKeyNotFound {
+				return nil, err
+			}
+			conn.WriteArray(len(values))
+			for _, value := range values {
+				if value == nil {
 					conn.WriteNull()
-					return nil, nil
+				} else {
+					conn.WriteBulk(value)
 				}
-				return nil, err
 			}
-			conn.WriteBulk(value)
 			return nil, nil
 		},
 	)
 }
 
+// mget returns the values of keys, with nil for keys that do not exist.
+func (kvm *Machine) mget(keys [][]byte) ([][]byte, error) {
+	kvm.mu.RLock()
+	defer kvm.mu.RUnlock()
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		value, err := kvm.db.Get(string(key))
+		if err != nil {
+			if err == bitcask.ErrKeyNotFound {
+				atomic.AddInt64(&kvm.misses, 1)
+				continue
+			}
+			return nil, err
+		}
+		atomic.AddInt64(&kvm.hits, 1)
+		if value == nil {
+			value = []byte{}
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
 func (kvm *Machine) cmdDel(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
 	var startIdx = 1
 	return m.Apply(conn, cmd,
 		func() (interface{}, error) {
@@ -319,12 +1278,25 @@ func (kvm *Machine) cmdDel(m finn.Applier, conn redcon.Conn, cmd redcon.Command)
 			var n int
 			for i := startIdx; i < len(cmd.Args); i++ {
 				key := string(cmd.Args[i])
-				err := kvm.db.Delete(key)
+				// Only count keys that existed, like Redis does.
+				ok, err := kvm.exists(key)
 				if err != nil {
 					return 0, err
 				}
+				if !ok {
+					continue
+				}
+				if err := kvm.db.Delete(key); err != nil {
+					return 0, kvm.writeErr(err)
+				}
 				n++
 			}
+			if n > 0 {
+				if err := kvm.syncWrite(); err != nil {
+					return 0, kvm.writeErr(err)
+				}
+				kvm.recordWrite(cmd.Args)
+			}
 			return n, nil
 		},
 		func(v interface{}) (interface{}, error) {
@@ -336,55 +1308,142 @@ func (kvm *Machine) cmdDel(m finn.Applier, conn redcon.Conn, cmd redcon.Command)
 }
 
 func (kvm *Machine) cmdKeys(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
-	if len(cmd.Args) < 2 {
+	args, level, err := kvm.readLevel(cmd.Args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 2 {
 		return nil, finn.ErrWrongNumberOfArguments
 	}
-	var withvalues bool
-	for i := 2; i < len(cmd.Args); i++ {
-		switch strings.ToLower(string(cmd.Args[i])) {
+	var withvalues, sorted bool
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
 		default:
 			return nil, errSyntaxError
 		case "withvalues":
 			withvalues = true
+		case "sort":
+			sorted = true
 		}
 	}
-	return m.Apply(conn, cmd, nil,
+	release, err := kvm.beginScan(conn)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return kvm.applyRead(m, conn, cmd, level,
 		func(interface{}) (interface{}, error) {
+			ctx, cancel := kvm.commandContext()
+			defer cancel()
+			ctx, done := kvm.trackOp(ctx, "keys")
+			defer done()
+			var prefix string
+			if st := stateOf(conn); st != nil {
+				prefix = st.prefix
+			}
 			kvm.mu.RLock()
 			defer kvm.mu.RUnlock()
-			var keys [][]byte
-			var values [][]byte
-
-			err := kvm.db.Fold(func(key string) error {
-				keys = append(keys, []byte(key))
-				if withvalues {
-					value, err := kvm.db.Get(key)
-					if err != nil {
-						return err
-					}
-					values = append(values, value)
-				}
-				return nil
-			})
-			if err != nil {
-				return nil, err
-			}
-			if withvalues {
-				conn.WriteArray(len(keys) * 2)
-			} else {
-				conn.WriteArray(len(keys))
+			if kvm.opts.KeysSingleFold || sorted {
+				return nil, kvm.writeKeysBuffered(ctx, conn, prefix, withvalues, sorted)
 			}
-			for i := 0; i < len(keys); i++ {
-				conn.WriteBulk(keys[i])
-				if withvalues {
-					conn.WriteBulk(values[i])
-				}
-			}
-			return nil, nil
+			return nil, kvm.writeKeysStreamed(ctx, conn, prefix, withvalues)
 		},
 	)
 }
 
+// writeKeysBuffered collects every key under prefix, and its value if
+// withvalues is set, in a single fold and then writes them to conn with the
+// prefix stripped, in lexicographic order if sorted is set. It is the
+// fastest path but holds the whole reply in memory. The caller must hold
+// kvm.mu.
+func (kvm *Machine) writeKeysBuffered(ctx context.Context, conn redcon.Conn, prefix string, withvalues, sorted bool) error {
+	var keys [][]byte
+	var values [][]byte
+
+	err := kvm.foldPrefix(ctx, prefix, func(key string) error {
+		keys = append(keys, []byte(key[len(prefix):]))
+		if withvalues {
+			value, err := kvm.db.Get(key)
+			if err != nil {
+				return err
+			}
+			values = append(values, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if sorted {
+		sort.Sort(sortedKeys{keys, values})
+	}
+	if withvalues {
+		conn.WriteArray(len(keys) * 2)
+	} else {
+		conn.WriteArray(len(keys))
+	}
+	for i := 0; i < len(keys); i++ {
+		conn.WriteBulk(keys[i])
+		if withvalues {
+			conn.WriteBulk(values[i])
+		}
+	}
+	return nil
+}
+
+// sortedKeys sorts keys, along with their values if there are any.
+type sortedKeys struct {
+	keys   [][]byte
+	values [][]byte
+}
+
+func (s sortedKeys) Len() int           { return len(s.keys) }
+func (s sortedKeys) Less(i, j int) bool { return bytes.Compare(s.keys[i], s.keys[j]) < 0 }
+func (s sortedKeys) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	if s.values != nil {
+		s.values[i], s.values[j] = s.values[j], s.values[i]
+	}
+}
+
+// writeKeysStreamed folds once to count the keys under prefix so the array
+// header can be written up front, then folds again streaming each key, with
+// the prefix stripped, and its value if withvalues is set, straight to
+// conn. Memory stays bounded at the cost of a second pass. The caller must
+// hold kvm.mu, which keeps both folds consistent.
+func (kvm *Machine) writeKeysStreamed(ctx context.Context, conn redcon.Conn, prefix string, withvalues bool) error {
+	var count int
+	err := kvm.foldPrefix(ctx, prefix, func(key string) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if withvalues {
+		conn.WriteArray(count * 2)
+	} else {
+		conn.WriteArray(count)
+	}
+	err = kvm.foldPrefix(ctx, prefix, func(key string) error {
+		if !withvalues {
+			conn.WriteBulk([]byte(key[len(prefix):]))
+			return nil
+		}
+		value, err := kvm.db.Get(key)
+		if err != nil {
+			return err
+		}
+		conn.WriteBulk([]byte(key[len(prefix):]))
+		conn.WriteBulk(value)
+		return nil
+	})
+	if err != nil {
+		abortReply(conn, err)
+	}
+	return nil
+}
+
 func (kvm *Machine) cmdFlushdb(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
 	if len(cmd.Args) != 1 {
 		return nil, finn.ErrWrongNumberOfArguments
@@ -394,7 +1453,7 @@ func (kvm *Machine) cmdFlushdb(m finn.Applier, conn redcon.Conn, cmd redcon.Comm
 			kvm.mu.Lock()
 			defer kvm.mu.Unlock()
 			if err := kvm.db.Sync(); err != nil {
-				panic(err.Error())
+				return nil, kvm.writeErr(err)
 			}
 			return nil, nil
 		},
@@ -0,0 +1,755 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// testApplier applies commands directly, as a single node cluster would:
+// mutate (if any) then respond.
+type testApplier struct {
+	finn.Applier
+}
+
+func (testApplier) Apply(conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	var v interface{}
+	if mutate != nil {
+		var err error
+		if v, err = mutate(); err != nil {
+			return nil, err
+		}
+	}
+	return respond(v)
+}
+
+// testConn records the replies written to it.
+type testConn struct {
+	redcon.Conn
+	ctx     interface{}
+	addr    string // remote address, 127.0.0.1:50000 if empty
+	closed  bool
+	replies []interface{}
+}
+
+func (c *testConn) RemoteAddr() string {
+	if c.addr != "" {
+		return c.addr
+	}
+	return "127.0.0.1:50000"
+}
+func (c *testConn) Close() error             { c.closed = true; return nil }
+func (c *testConn) Context() interface{}     { return c.ctx }
+func (c *testConn) SetContext(v interface{}) { c.ctx = v }
+func (c *testConn) WriteError(msg string)    { c.replies = append(c.replies, "-"+msg) }
+func (c *testConn) WriteString(str string)   { c.replies = append(c.replies, "+"+str) }
+func (c *testConn) WriteBulk(bulk []byte)    { c.replies = append(c.replies, string(bulk)) }
+func (c *testConn) WriteBulkString(s string) { c.replies = append(c.replies, s) }
+func (c *testConn) WriteInt(num int)         { c.replies = append(c.replies, num) }
+func (c *testConn) WriteInt64(num int64)     { c.replies = append(c.replies, int(num)) }
+func (c *testConn) WriteArray(count int)     { c.replies = append(c.replies, []int{count}) }
+func (c *testConn) WriteNull()               { c.replies = append(c.replies, nil) }
+
+// newTestMachine opens a Machine in a temporary directory.
+func newTestMachine(t *testing.T) (*Machine, func()) {
+	dir, err := ioutil.TempDir("", "bitraft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvm, err := NewMachine(dir, "127.0.0.1:4920", nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return kvm, func() {
+		kvm.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// do runs a command against kvm and returns the replies written to conn
+// along with any error returned by the handler.
+func do(kvm *Machine, conn *testConn, args ...string) ([]interface{}, error) {
+	cmd := redcon.Command{}
+	for _, arg := range args {
+		cmd.Args = append(cmd.Args, []byte(arg))
+	}
+	conn.replies = nil
+	_, err := kvm.Command(testApplier{}, conn, cmd)
+	return conn.replies, err
+}
+
+// serveTestMachine serves kvm over RESP on a free loopback port, applying
+// commands as testApplier does and accepting connections with
+// kvm.connAccept. It returns the address and a function stopping the
+// server.
+func serveTestMachine(t *testing.T, kvm *Machine) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	srv := redcon.NewServer(addr,
+		func(conn redcon.Conn, cmd redcon.Command) {
+			if _, err := kvm.Command(testApplier{}, conn, cmd); err != nil {
+				conn.WriteError("ERR " + err.Error())
+			}
+		},
+		kvm.connAccept, nil)
+	signal := make(chan error, 1)
+	go srv.ListenServeAndSignal(signal)
+	if err := <-signal; err != nil {
+		t.Fatal(err)
+	}
+	return addr, func() { srv.Close() }
+}
+
+func TestValidateAddr(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		addr  string
+		valid bool
+	}{
+		{"127.0.0.1:4920", true},
+		{"127.0.0.1", false},
+		{":4920", false},
+		{"127.0.0.1:0", false},
+		{"127.0.0.1:65536", false},
+		{"127.0.0.1:redis", false},
+		{"[::1]:4920", true},
+		{"[::]:4920", true},
+		{"::1:4920", false},
+		{"[::1]", false},
+	}
+
+	for _, tc := range testCases {
+		_, err := validateAddr(tc.addr)
+		if tc.valid {
+			assert.NoError(err, tc.addr)
+		} else {
+			assert.Error(err, tc.addr)
+		}
+	}
+}
+
+func TestReadLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm := &Machine{consistency: finn.Medium}
+
+	args, level, err := kvm.readLevel([][]byte{[]byte("get"), []byte("foo")})
+	assert.NoError(err)
+	assert.Equal(finn.Medium, level)
+	assert.Len(args, 2)
+
+	args, level, err = kvm.readLevel([][]byte{
+		[]byte("get"), []byte("foo"), []byte("CONSISTENCY"), []byte("high"),
+	})
+	assert.NoError(err)
+	assert.Equal(finn.High, level)
+	assert.Len(args, 2)
+
+	_, _, err = kvm.readLevel([][]byte{
+		[]byte("get"), []byte("foo"), []byte("consistency"), []byte("bogus"),
+	})
+	assert.Equal(errSyntaxError, err)
+}
+
+func TestDel(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	_, err := do(kvm, conn, "set", "foo", "1")
+	assert.NoError(err)
+	_, err = do(kvm, conn, "set", "bar", "2")
+	assert.NoError(err)
+
+	replies, err := do(kvm, conn, "del", "foo", "bar", "missing", "foo")
+	assert.NoError(err)
+	assert.Equal([]interface{}{2}, replies)
+
+	replies, err = do(kvm, conn, "get", "foo")
+	assert.NoError(err)
+	assert.Equal([]interface{}{nil}, replies)
+}
+
+// BenchmarkMget compares reading the keys of a 1000 key MGET one after
+// another, as cmdMget does, with fanning the reads out to a pool of
+// goroutines.
+func BenchmarkMget(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bitraft")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kvm, err := NewMachine(dir, "127.0.0.1:4920", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer kvm.Close()
+
+	value := make([]byte, 128)
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%d", i))
+		if err := kvm.db.Put(string(keys[i]), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("Serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := kvm.mget(keys); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Concurrent", func(b *testing.B) {
+		const workers = 8
+		for i := 0; i < b.N; i++ {
+			values := make([][]byte, len(keys))
+			errs := make([]error, workers)
+			var wg sync.WaitGroup
+			kvm.mu.RLock()
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for j := w; j < len(keys); j += workers {
+						values[j], errs[w] = kvm.db.Get(string(keys[j]))
+						if errs[w] != nil {
+							return
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+			kvm.mu.RUnlock()
+			for _, err := range errs {
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkSnapshot(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bitraft")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kvm, err := NewMachine(dir, "127.0.0.1:4920", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer kvm.Close()
+
+	value := make([]byte, 128)
+	for i := 0; i < 100000; i++ {
+		if err := kvm.db.Put(fmt.Sprintf("key%d", i), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	f, err := ioutil.TempFile(dir, "snapshot")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, size := range []int{16, 4096, defaultSnapshotBufferSize, 1 << 20} {
+		b.Run(fmt.Sprintf("BufferSize%d", size), func(b *testing.B) {
+			kvm.opts.SnapshotBufferSize = size
+			for i := 0; i < b.N; i++ {
+				if _, err := f.Seek(0, 0); err != nil {
+					b.Fatal(err)
+				}
+				if err := kvm.Snapshot(f); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestUseprefix(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+
+	tenant := &testConn{}
+	other := &testConn{}
+
+	_, err := do(kvm, other, "set", "foo", "other")
+	assert.NoError(err)
+
+	replies, err := do(kvm, tenant, "useprefix", "tenant:")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"+OK"}, replies)
+
+	_, err = do(kvm, tenant, "set", "foo", "tenant")
+	assert.NoError(err)
+
+	replies, err = do(kvm, tenant, "get", "foo")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"tenant"}, replies)
+
+	replies, err = do(kvm, other, "get", "tenant:foo")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"tenant"}, replies)
+
+	replies, err = do(kvm, tenant, "keys", "*")
+	assert.NoError(err)
+	assert.Equal([]interface{}{[]int{1}, "foo"}, replies)
+
+	_, err = do(kvm, tenant, "reset")
+	assert.NoError(err)
+	replies, err = do(kvm, tenant, "get", "foo")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"other"}, replies)
+}
+
+func TestRespError(t *testing.T) {
+	assert := assert.New(t)
+
+	err := &respError{"WRONGTYPE", "Operation against a key holding the wrong kind of value"}
+	assert.EqualError(err, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestReadonly(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	do(kvm, conn, "set", "foo", "bar")
+	replies, err := do(kvm, conn, "readonly")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"+OK"}, replies)
+
+	replies, err = do(kvm, conn, "get", "foo", "consistency", "high")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"bar"}, replies)
+
+	replies, err = do(kvm, conn, "set", "foo", "baz")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"-" + errReadonlyConn.Error()}, replies)
+
+	do(kvm, conn, "readwrite")
+	replies, err = do(kvm, conn, "set", "foo", "baz")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"+OK"}, replies)
+}
+
+func TestSetGet(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	replies, err := do(kvm, conn, "set", "foo", "bar", "get")
+	assert.NoError(err)
+	assert.Equal([]interface{}{nil}, replies)
+
+	replies, err = do(kvm, conn, "set", "foo", "baz", "GET")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"bar"}, replies)
+
+	replies, _ = do(kvm, conn, "get", "foo")
+	assert.Equal([]interface{}{"baz"}, replies)
+
+	_, err = do(kvm, conn, "set", "foo", "bar", "nx")
+	assert.Equal(errSyntaxError, err)
+}
+
+func TestMget(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	do(kvm, conn, "set", "foo", "1")
+	do(kvm, conn, "set", "bar", "")
+
+	replies, err := do(kvm, conn, "mget", "foo", "missing", "bar", "CONSISTENCY", "low")
+	assert.NoError(err)
+	assert.Equal([]interface{}{[]int{3}, "1", nil, ""}, replies)
+
+	do(kvm, conn, "useprefix", "t:")
+	do(kvm, conn, "set", "foo", "2")
+	replies, err = do(kvm, conn, "mget", "foo", "bar", "consistency", "low")
+	assert.NoError(err)
+	assert.Equal([]interface{}{[]int{2}, "2", nil}, replies)
+
+	_, err = do(kvm, conn, "mget")
+	assert.Equal(finn.ErrWrongNumberOfArguments, err)
+}
+
+func TestIncrbyfloat(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	replies, err := do(kvm, conn, "incrbyfloat", "n", "10.50")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"10.5"}, replies)
+
+	replies, err = do(kvm, conn, "incrbyfloat", "n", "-0.5")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"10"}, replies)
+
+	replies, _ = do(kvm, conn, "get", "n")
+	assert.Equal([]interface{}{"10"}, replies)
+
+	replies, _ = do(kvm, conn, "incrbyfloat", "n", "abc")
+	assert.Equal([]interface{}{"-" + errNotFloat.Error()}, replies)
+
+	do(kvm, conn, "set", "s", "abc")
+	replies, _ = do(kvm, conn, "incrbyfloat", "s", "1")
+	assert.Equal([]interface{}{"-" + errNotFloat.Error()}, replies)
+
+	do(kvm, conn, "set", "big", "1.7e308")
+	replies, _ = do(kvm, conn, "incrbyfloat", "big", "1.7e308")
+	assert.Equal([]interface{}{"-" + errNaNOrInf.Error()}, replies)
+}
+
+func TestMaxConcurrentScans(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	kvm.opts.MaxConcurrentScans = 1
+	conn := &testConn{}
+	do(kvm, conn, "set", "foo", "bar")
+
+	release, err := kvm.beginScan(conn)
+	assert.NoError(err)
+	for _, args := range [][]string{{"keys", "*"}, {"getpattern", "*"}, {"export"}, {"info", "values-histogram"}} {
+		replies, _ := do(kvm, conn, args...)
+		assert.Equal([]interface{}{"-" + errTooManyScans.Error()}, replies)
+	}
+
+	release()
+	replies, _ := do(kvm, conn, "keys", "*")
+	assert.Equal([]interface{}{[]int{1}, "foo"}, replies)
+	assert.Equal(int32(0), kvm.scans)
+}
+
+// leaderlessApplier fails every command like finn does during an
+// election.
+type leaderlessApplier struct {
+	finn.Applier
+	calls int
+}
+
+func (a *leaderlessApplier) Apply(conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	a.calls++
+	return nil, errors.New("leader unknown")
+}
+
+func TestWaitForLeaderTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	// Nothing listens here, so the cluster never has a leader.
+	kvm.addr = "127.0.0.1:1"
+	conn := &testConn{}
+	cmd := redcon.Command{Args: [][]byte{[]byte("set"), []byte("foo"), []byte("bar")}}
+
+	m := &leaderlessApplier{}
+	_, err := kvm.Command(m, conn, cmd)
+	assert.True(isLeaderUnknown(err))
+	assert.Equal(1, m.calls)
+
+	kvm.opts.WaitForLeaderTimeout = 250 * time.Millisecond
+	start := time.Now()
+	_, err = kvm.Command(m, conn, cmd)
+	assert.True(isLeaderUnknown(err))
+	assert.True(time.Since(start) >= kvm.opts.WaitForLeaderTimeout)
+	assert.Equal(2, m.calls)
+}
+
+func TestSplitJoin(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(splitJoin(""))
+	assert.Equal([]string{"127.0.0.1:4920"}, splitJoin("127.0.0.1:4920"))
+	assert.Equal([]string{"127.0.0.1:4920", "[::1]:4920"}, splitJoin("127.0.0.1:4920, [::1]:4920,"))
+}
+
+func TestKeysSort(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	for _, key := range []string{"c", "a", "b"} {
+		do(kvm, conn, "set", key, key+"1")
+	}
+	replies, err := do(kvm, conn, "keys", "*", "sort")
+	assert.NoError(err)
+	assert.Equal([]interface{}{[]int{3}, "a", "b", "c"}, replies)
+
+	replies, err = do(kvm, conn, "keys", "*", "withvalues", "sort")
+	assert.NoError(err)
+	assert.Equal([]interface{}{[]int{6}, "a", "a1", "b", "b1", "c", "c1"}, replies)
+}
+
+func TestFlushdbSyncError(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	// Syncing a closed database fails.
+	assert.NoError(kvm.db.Close())
+	assert.NotPanics(func() {
+		_, err := do(kvm, conn, "flushdb")
+		assert.Error(err)
+	})
+
+	replies, err := do(kvm, conn, "echo", "alive")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"alive"}, replies)
+}
+
+func TestProtectedMode(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	kvm.opts.ProtectedMode = true
+
+	replies, err := do(kvm, &testConn{addr: "[::1]:50000"}, "echo", "foo")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"foo"}, replies)
+
+	replies, err = do(kvm, &testConn{addr: "10.0.1.5:50000"}, "echo", "foo")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"-" + errProtectedMode.Error()}, replies)
+
+	kvm.opts.ProtectedMode = false
+	replies, _ = do(kvm, &testConn{addr: "10.0.1.5:50000"}, "echo", "foo")
+	assert.Equal([]interface{}{"foo"}, replies)
+}
+
+func TestClient(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	replies, err := do(kvm, conn, "client", "no-evict", "on")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"+OK"}, replies)
+	replies, _ = do(kvm, conn, "client", "NO-TOUCH", "on")
+	assert.Equal([]interface{}{"+OK"}, replies)
+	assert.True(stateOf(conn).noEvict)
+	assert.True(stateOf(conn).noTouch)
+
+	replies, _ = do(kvm, conn, "client", "bogus")
+	assert.Equal([]interface{}{"-ERR unknown subcommand 'bogus'"}, replies)
+}
+
+func TestClientCompress(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	value := strings.Repeat("a", 100)
+	do(kvm, conn, "set", "big", value)
+	do(kvm, conn, "set", "small", "b")
+	do(kvm, conn, "set", "magic", string(compressMagic))
+
+	replies, err := do(kvm, conn, "client", "compress", "64")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"+OK"}, replies)
+
+	decompress := func(reply interface{}) string {
+		s := reply.(string)
+		if !assert.True(strings.HasPrefix(s, string(compressMagic))) {
+			return ""
+		}
+		zr, err := gzip.NewReader(strings.NewReader(s[len(compressMagic):]))
+		if !assert.NoError(err) {
+			return ""
+		}
+		b, err := ioutil.ReadAll(zr)
+		assert.NoError(err)
+		return string(b)
+	}
+	replies, _ = do(kvm, conn, "get", "big")
+	assert.Equal(value, decompress(replies[0]))
+	replies, _ = do(kvm, conn, "get", "magic")
+	assert.Equal(string(compressMagic), decompress(replies[0]))
+	replies, _ = do(kvm, conn, "get", "small")
+	assert.Equal([]interface{}{"b"}, replies)
+
+	do(kvm, conn, "client", "compress", "off")
+	replies, _ = do(kvm, conn, "get", "big")
+	assert.Equal([]interface{}{value}, replies)
+
+	_, err = do(kvm, conn, "client", "compress", "0")
+	assert.Equal(errSyntaxError, err)
+}
+
+func TestHelp(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	for _, name := range []string{"OBJECT", "CLIENT", "CONFIG", "DEBUG", "RAFT", "OPS"} {
+		replies, err := do(kvm, conn, name, "help")
+		assert.NoError(err)
+		if !assert.True(len(replies) > 3, name) {
+			continue
+		}
+		assert.Equal([]int{len(replies) - 1}, replies[0])
+		assert.Equal("+"+name+" <subcommand> [<arg> [value] [opt] ...]. Subcommands are:", replies[1])
+		assert.Equal("+    Print this help.", replies[len(replies)-1])
+		// Subcommands alternate with their indented descriptions.
+		for i, reply := range replies[2:] {
+			assert.Equal(i%2 == 1, strings.HasPrefix(reply.(string), "+    "), reply)
+		}
+	}
+}
+
+func TestObject(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	do(kvm, conn, "set", "foo", "bar")
+	replies, err := do(kvm, conn, "object", "refcount", "foo")
+	assert.NoError(err)
+	assert.Equal([]interface{}{1}, replies)
+
+	replies, _ = do(kvm, conn, "object", "refcount", "missing")
+	assert.Equal([]interface{}{"-" + errNoSuchKey.Error()}, replies)
+
+	replies, err = do(kvm, conn, "debug", "object", "foo")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"+Value at:0 refcount:1 encoding:raw serializedlength:3 lru:0 lru_seconds_idle:0"}, replies)
+}
+
+func TestUnknownCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+
+	replies, err := do(kvm, &testConn{}, "bogus", "arg")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"-ERR unknown command 'bogus'"}, replies)
+}
+
+func TestReadTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	kvm.opts.ReadTimeout = 100 * time.Millisecond
+	addr, stop := serveTestMachine(t, kvm)
+	defer stop()
+
+	// closed reports whether the server closes c within a second.
+	closed := func(c net.Conn) bool {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := ioutil.ReadAll(c)
+		return err == nil
+	}
+
+	t.Run("Idle", func(t *testing.T) {
+		c, err := net.Dial("tcp", addr)
+		assert.NoError(err)
+		defer c.Close()
+		assert.True(closed(c))
+	})
+
+	t.Run("HalfCommand", func(t *testing.T) {
+		c, err := net.Dial("tcp", addr)
+		assert.NoError(err)
+		defer c.Close()
+		_, err = c.Write([]byte("*2\r\n$3\r\nGET\r\n"))
+		assert.NoError(err)
+		assert.True(closed(c))
+	})
+
+	t.Run("Refreshed", func(t *testing.T) {
+		c, err := net.Dial("tcp", addr)
+		assert.NoError(err)
+		defer c.Close()
+		buf := make([]byte, 64)
+		for i := 0; i < 4; i++ {
+			time.Sleep(60 * time.Millisecond)
+			_, err = c.Write([]byte("*2\r\n$4\r\nECHO\r\n$2\r\nhi\r\n"))
+			assert.NoError(err)
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := c.Read(buf)
+			assert.NoError(err)
+			assert.Equal("$2\r\nhi\r\n", string(buf[:n]))
+		}
+	})
+
+	t.Run("Peer", func(t *testing.T) {
+		kvm, cleanup := newTestMachine(t)
+		defer cleanup()
+		kvm.opts.ReadTimeout = 100 * time.Millisecond
+		kvm.peers = newPeerHosts(kvm.dir, []string{"127.0.0.1:4921"})
+		addr, stop := serveTestMachine(t, kvm)
+		defer stop()
+
+		c, err := net.Dial("tcp", addr)
+		assert.NoError(err)
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		_, err = c.Read(make([]byte, 1))
+		if assert.Error(err) {
+			ne, ok := err.(net.Error)
+			assert.True(ok && ne.Timeout(), "peer connection closed: %v", err)
+		}
+	})
+}
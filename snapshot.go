@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A snapshot is a sequence of records, each a key and then a value, both
+// prefixed by their length, and is usually gzip compressed.
+//
+// The original format has no header and 8 byte little endian lengths; it is
+// what gzip compressed snapshots still use, so that nodes running older
+// versions can restore them. Other formats start with snapshotMagic and a
+// version byte.
+const snapshotMagic = "bitraft"
+
+// Snapshot format versions. All but snapshotOriginal follow snapshotMagic.
+const (
+	// snapshotOriginal is the original headerless format.
+	snapshotOriginal = 0
+	// snapshotV1 has the same records as the original format.
+	snapshotV1 = 1
+	// snapshotV2 has unsigned varint lengths, which for small keys and
+	// values take a fraction of the 16 bytes per record of snapshotV1.
+	snapshotV2 = 2
+)
+
+// gzipMagic is the header of a gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+var errUnknownSnapshotVersion = errors.New("unknown snapshot version")
+
+// maxSnapshotRecordLen bounds the length of a key or value read from a
+// snapshot, as Redis' proto-max-bulk-len bounds bulk strings, so that a
+// corrupt length fails the read instead of allocating an arbitrary amount
+// of memory.
+const maxSnapshotRecordLen = 512 << 20
+
+// snapshotWriter writes snapshot records.
+type snapshotWriter struct {
+	w      io.Writer
+	varint bool
+	buf    []byte
+}
+
+// newSnapshotWriter returns a writer of snapshot records to w in the given
+// format version, starting with its header.
+func newSnapshotWriter(w io.Writer, version byte) (*snapshotWriter, error) {
+	sw := &snapshotWriter{w: w, varint: version == snapshotV2}
+	if version != snapshotOriginal {
+		header := append([]byte(snapshotMagic), version)
+		if _, err := w.Write(header); err != nil {
+			return nil, err
+		}
+	}
+	return sw, nil
+}
+
+// Write writes a record.
+func (sw *snapshotWriter) Write(key, value []byte) error {
+	sw.buf = sw.buf[:0]
+	sw.buf = sw.appendLen(sw.buf, len(key))
+	sw.buf = append(sw.buf, key...)
+	sw.buf = sw.appendLen(sw.buf, len(value))
+	sw.buf = append(sw.buf, value...)
+	_, err := sw.w.Write(sw.buf)
+	return err
+}
+
+// appendLen appends a record length to buf.
+func (sw *snapshotWriter) appendLen(buf []byte, n int) []byte {
+	var num [binary.MaxVarintLen64]byte
+	if sw.varint {
+		return append(buf, num[:binary.PutUvarint(num[:], uint64(n))]...)
+	}
+	binary.LittleEndian.PutUint64(num[:8], uint64(n))
+	return append(buf, num[:8]...)
+}
+
+// snapshotReader reads snapshot records in any supported format.
+type snapshotReader struct {
+	r      *bufio.Reader
+	gzr    *gzip.Reader
+	varint bool
+}
+
+// newSnapshotReader returns a reader of the records in rd, decompressing it
+// if it is gzip compressed and detecting its format.
+func newSnapshotReader(rd io.Reader) (*snapshotReader, error) {
+	sr := &snapshotReader{r: bufio.NewReader(rd)}
+	if magic, err := sr.r.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		sr.gzr, err = gzip.NewReader(sr.r)
+		if err != nil {
+			return nil, err
+		}
+		sr.r = bufio.NewReader(sr.gzr)
+	}
+	header, err := sr.r.Peek(len(snapshotMagic) + 1)
+	if err == nil && string(header[:len(snapshotMagic)]) == snapshotMagic {
+		switch version := header[len(snapshotMagic)]; version {
+		default:
+			return nil, fmt.Errorf("%v %d", errUnknownSnapshotVersion, version)
+		case snapshotV1:
+		case snapshotV2:
+			sr.varint = true
+		}
+		sr.r.Discard(len(header))
+	}
+	return sr, nil
+}
+
+// Next returns the next record. It returns io.EOF after the last record and
+// io.ErrUnexpectedEOF if the snapshot is truncated.
+func (sr *snapshotReader) Next() (key, value []byte, err error) {
+	n, err := sr.readLen()
+	if err != nil {
+		return nil, nil, err
+	}
+	key = make([]byte, n)
+	if _, err := io.ReadFull(sr.r, key); err != nil {
+		return nil, nil, unexpectedEOF(err)
+	}
+	if n, err = sr.readLen(); err != nil {
+		return nil, nil, unexpectedEOF(err)
+	}
+	value = make([]byte, n)
+	if _, err := io.ReadFull(sr.r, value); err != nil {
+		return nil, nil, unexpectedEOF(err)
+	}
+	return key, value, nil
+}
+
+// readLen reads a record length. It returns io.EOF only if no byte of it
+// could be read, and an error if the length exceeds maxSnapshotRecordLen.
+func (sr *snapshotReader) readLen() (int, error) {
+	var n uint64
+	if sr.varint {
+		var err error
+		if n, err = binary.ReadUvarint(sr.r); err != nil {
+			return 0, err
+		}
+	} else {
+		var num [8]byte
+		if _, err := io.ReadFull(sr.r, num[:]); err != nil {
+			return 0, err
+		}
+		n = binary.LittleEndian.Uint64(num[:])
+	}
+	if n > maxSnapshotRecordLen {
+		return 0, fmt.Errorf("invalid snapshot record length %d", n)
+	}
+	return int(n), nil
+}
+
+// Close checks the gzip checksum, if the snapshot was compressed.
+func (sr *snapshotReader) Close() error {
+	if sr.gzr != nil {
+		return sr.gzr.Close()
+	}
+	return nil
+}
+
+// unexpectedEOF turns io.EOF in the middle of a record into
+// io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
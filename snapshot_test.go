@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, gzipped := range []bool{true, false} {
+		assert := assert.New(t)
+
+		src, cleanup := newTestMachine(t)
+		defer cleanup()
+		src.opts.DisableSnapshotGzip = !gzipped
+		conn := &testConn{}
+		do(src, conn, "SET", "foo", "bar")
+		do(src, conn, "SET", "empty", "")
+
+		var buf bytes.Buffer
+		assert.NoError(src.Snapshot(&buf))
+		assert.Equal(gzipped, bytes.HasPrefix(buf.Bytes(), gzipMagic))
+
+		dst, cleanup := newTestMachine(t)
+		defer cleanup()
+		assert.NoError(dst.Restore(&buf))
+		replies, _ := do(dst, conn, "GET", "foo")
+		assert.Equal([]interface{}{"bar"}, replies)
+		replies, _ = do(dst, conn, "GET", "empty")
+		assert.Equal([]interface{}{""}, replies)
+	}
+}
+
+func TestSnapshotVarint(t *testing.T) {
+	for _, gzipped := range []bool{true, false} {
+		assert := assert.New(t)
+
+		src, cleanup := newTestMachine(t)
+		defer cleanup()
+		src.opts.DisableSnapshotGzip = !gzipped
+		src.opts.SnapshotVarint = true
+		conn := &testConn{}
+		do(src, conn, "SET", "foo", strings.Repeat("a", 300))
+		do(src, conn, "SET", "empty", "")
+
+		var buf bytes.Buffer
+		assert.NoError(src.Snapshot(&buf))
+
+		dst, cleanup := newTestMachine(t)
+		defer cleanup()
+		assert.NoError(dst.Restore(&buf))
+		replies, _ := do(dst, conn, "MGET", "foo", "empty")
+		assert.Equal([]interface{}{[]int{2}, strings.Repeat("a", 300), ""}, replies)
+	}
+}
+
+// TestSnapshotVarintSize compares the size of snapshots of a million
+// small records in each format.
+func TestSnapshotVarintSize(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	assert := assert.New(t)
+
+	var sizes [2]int
+	for i, version := range []byte{snapshotV1, snapshotV2} {
+		var buf bytes.Buffer
+		sw, _ := newSnapshotWriter(&buf, version)
+		for j := 0; j < 1000000; j++ {
+			sw.Write([]byte(fmt.Sprintf("user:%d", j)), []byte(strconv.Itoa(j%100)))
+		}
+		sizes[i] = buf.Len()
+	}
+	t.Logf("fixed: %d bytes, varint: %d bytes", sizes[0], sizes[1])
+	assert.Equal(sizes[0]-14*1000000, sizes[1])
+}
+
+func TestSnapshotReaderTruncatedVarint(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	sw, _ := newSnapshotWriter(&buf, snapshotV2)
+	sw.Write([]byte("foo"), bytes.Repeat([]byte("a"), 200))
+
+	sr, err := newSnapshotReader(bytes.NewReader(buf.Bytes()[:len(snapshotMagic)+1+1+3+1]))
+	assert.NoError(err)
+	_, _, err = sr.Next()
+	assert.Equal(io.ErrUnexpectedEOF, err)
+}
+
+func TestSnapshotReaderLegacy(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	sw, _ := newSnapshotWriter(&buf, snapshotOriginal)
+	sw.Write([]byte("foo"), []byte("bar"))
+
+	sr, err := newSnapshotReader(&buf)
+	assert.NoError(err)
+	key, value, err := sr.Next()
+	assert.NoError(err)
+	assert.Equal("foo", string(key))
+	assert.Equal("bar", string(value))
+	_, _, err = sr.Next()
+	assert.Equal(io.EOF, err)
+}
+
+func TestWriteRedisCommandsFromSnapshotReader(t *testing.T) {
+	assert := assert.New(t)
+
+	var snap bytes.Buffer
+	sw, _ := newSnapshotWriter(&snap, snapshotV1)
+	sw.Write([]byte("foo"), []byte("bar"))
+
+	var out bytes.Buffer
+	assert.NoError(WriteRedisCommandsFromSnapshotReader(&out, &snap))
+	assert.Equal("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n", out.String())
+}
+
+func TestDebugReload(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	do(kvm, conn, "set", "foo", "bar")
+	replies, err := do(kvm, conn, "debug", "reload")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"+OK"}, replies)
+
+	replies, _ = do(kvm, conn, "get", "foo")
+	assert.Equal([]interface{}{"bar"}, replies)
+}
+
+func TestRestoreTruncated(t *testing.T) {
+	assert := assert.New(t)
+
+	src, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+	do(src, conn, "set", "new", "value")
+	var buf bytes.Buffer
+	assert.NoError(src.Snapshot(&buf))
+
+	dst, cleanup := newTestMachine(t)
+	defer cleanup()
+	do(dst, conn, "set", "old", "value")
+
+	truncated := buf.Bytes()[:buf.Len()-4]
+	assert.Error(dst.Restore(bytes.NewReader(truncated)))
+	replies, _ := do(dst, conn, "get", "old")
+	assert.Equal([]interface{}{"value"}, replies)
+	replies, _ = do(dst, conn, "get", "new")
+	assert.Equal([]interface{}{nil}, replies)
+
+	// A complete snapshot replaces the existing keys.
+	assert.NoError(dst.Restore(&buf))
+	replies, _ = do(dst, conn, "get", "old")
+	assert.Equal([]interface{}{nil}, replies)
+	replies, _ = do(dst, conn, "get", "new")
+	assert.Equal([]interface{}{"value"}, replies)
+}
+
+func TestSnapshotCorruptLength(t *testing.T) {
+	for _, version := range []byte{snapshotOriginal, snapshotV1, snapshotV2} {
+		assert := assert.New(t)
+
+		var buf bytes.Buffer
+		sw, err := newSnapshotWriter(&buf, version)
+		assert.NoError(err)
+		// A length far beyond the data, as from a corrupt file, must fail
+		// the read rather than be allocated.
+		buf.Write(sw.appendLen(nil, 1<<62))
+		buf.WriteString("key")
+
+		sr, err := newSnapshotReader(&buf)
+		assert.NoError(err)
+		_, _, err = sr.Next()
+		assert.EqualError(err, fmt.Sprintf("invalid snapshot record length %d", uint64(1<<62)))
+	}
+}
+
+func TestBgsaveInProgress(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	kvm.saving = 1
+	_, err := do(kvm, conn, "bgsave")
+	assert.Equal(errSaveInProgress, err)
+	_, err = do(kvm, conn, "save")
+	assert.Equal(errSaveInProgress, err)
+
+	kvm.saving = 0
+	replies, _ := do(kvm, conn, "bgsave")
+	assert.Equal([]interface{}{"+Background saving started"}, replies)
+	for atomic.LoadInt32(&kvm.saving) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = os.Stat(filepath.Join(kvm.dir, saveFilename))
+	assert.NoError(err)
+}
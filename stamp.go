@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// stampedCommand wraps a write in the Raft log with the time the leader
+// received it: "STAMPED unixnano command [arg ...]". Only writes read back
+// from the log are stamped, so clients cannot send it.
+const stampedCommand = "stamped"
+
+// stampApplier is a finn.Applier logging writes stamped with the time, so
+// that every node records the same modification time for the keys they
+// write.
+type stampApplier struct {
+	finn.Applier
+	now func() time.Time
+}
+
+func (a stampApplier) Apply(conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if mutate != nil {
+		cmd = withStamp(cmd, a.now())
+	}
+	return a.Applier.Apply(conn, cmd, mutate, respond)
+}
+
+// withStamp returns cmd wrapped in a STAMPED command naming t.
+func withStamp(cmd redcon.Command, t time.Time) redcon.Command {
+	args := make([][]byte, 0, len(cmd.Args)+2)
+	args = append(args, []byte("STAMPED"), []byte(strconv.FormatInt(t.UnixNano(), 10)))
+	return buildCommand(append(args, cmd.Args...)...)
+}
+
+// unstamp returns the write wrapped in a STAMPED command read from the log
+// and its time in unix nanoseconds. Other commands, such as those logged
+// before writes were stamped, are returned as is with a time of 0.
+func unstamp(cmd redcon.Command) (redcon.Command, int64) {
+	if len(cmd.Args) < 3 || strings.ToLower(string(cmd.Args[0])) != stampedCommand {
+		return cmd, 0
+	}
+	t, err := strconv.ParseInt(string(cmd.Args[1]), 10, 64)
+	if err != nil {
+		return cmd, 0
+	}
+	return redcon.Command{Args: cmd.Args[2:]}, t
+}
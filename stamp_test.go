@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/redcon"
+)
+
+// replayApplier applies commands as finn does when applying them from the
+// Raft log: mutate only, as there is no client to respond to.
+type replayApplier struct {
+	testApplier
+}
+
+func (replayApplier) Apply(conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if mutate == nil {
+		return nil, nil
+	}
+	return mutate()
+}
+
+func TestObjectLastModified(t *testing.T) {
+	assert := assert.New(t)
+
+	leader, cleanup := newTestMachine(t)
+	defer cleanup()
+	conn := &testConn{}
+
+	// The leader logs the write stamped with the time it received it.
+	m := &recordingApplier{}
+	before := time.Now().Unix()
+	_, err := leader.Command(m, conn, redcon.Command{Args: [][]byte{
+		[]byte("set"), []byte("foo"), []byte("bar")}})
+	assert.NoError(err)
+	after := time.Now().Unix()
+	if !assert.Len(m.applied, 1) {
+		return
+	}
+	logged := m.applied[0]
+	assert.Equal("STAMPED", string(logged.Args[0]))
+	write, _ := unstamp(logged)
+	assert.Equal("set foo bar", joinArgs(write.Args))
+
+	// Every node applying it from the log records the same time.
+	var times []interface{}
+	for i := 0; i < 2; i++ {
+		kvm, cleanup := newTestMachine(t)
+		defer cleanup()
+		_, err := kvm.Command(replayApplier{}, nil, logged)
+		assert.NoError(err)
+		replies, err := do(kvm, conn, "object", "lastmodified", "foo")
+		assert.NoError(err)
+		times = append(times, replies...)
+
+		// The time is carried in snapshots.
+		var buf bytes.Buffer
+		assert.NoError(kvm.Snapshot(&buf))
+		dst, cleanup := newTestMachine(t)
+		defer cleanup()
+		assert.NoError(dst.Restore(bytes.NewReader(buf.Bytes())))
+		replies, err = do(dst, conn, "object", "lastmodified", "foo")
+		assert.NoError(err)
+		times = append(times, replies...)
+	}
+	if assert.Len(times, 4) {
+		mtime := int64(times[0].(int))
+		assert.True(mtime >= before && mtime <= after)
+		assert.Equal([]interface{}{times[0], times[0], times[0], times[0]}, times)
+	}
+
+	// Writes logged without a time have none.
+	do(leader, conn, "set", "old", "1")
+	replies, err := do(leader, conn, "object", "lastmodified", "old")
+	assert.NoError(err)
+	assert.Equal([]interface{}{-1}, replies)
+
+	do(leader, conn, "del", "old")
+	replies, _ = do(leader, conn, "object", "lastmodified", "old")
+	assert.Equal([]interface{}{"-" + errNoSuchKey.Error()}, replies)
+	replies, _ = do(leader, conn, "object", "lastmodified", "missing")
+	assert.Equal([]interface{}{"-" + errNoSuchKey.Error()}, replies)
+	_, err = do(leader, conn, "object", "lastmodified")
+	assert.Error(err)
+}
+
+func TestStampedFromClient(t *testing.T) {
+	assert := assert.New(t)
+
+	kvm, cleanup := newTestMachine(t)
+	defer cleanup()
+
+	replies, err := do(kvm, &testConn{}, "stamped", "1", "set", "foo", "bar")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"-ERR unknown command 'stamped'"}, replies)
+}
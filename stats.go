@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Latencies are counted in buckets of microseconds: each power of two is
+// split into histSubBuckets linear buckets, which bounds the error of a
+// percentile to 1/histSubBuckets of its value and the memory of a
+// histogram to histBuckets counters.
+const (
+	histSubBits    = 2
+	histSubBuckets = 1 << histSubBits
+	histBuckets    = (64 - histSubBits + 1) * histSubBuckets
+)
+
+// latencyHistogram is a fixed size histogram of latencies.
+type latencyHistogram struct {
+	counts [histBuckets]uint64
+	calls  uint64
+	usec   uint64
+}
+
+// histBucket returns the bucket of a latency of usec microseconds.
+func histBucket(usec uint64) int {
+	if usec < histSubBuckets {
+		return int(usec)
+	}
+	exp := bits.Len64(usec) - 1 - histSubBits
+	return (exp+1)*histSubBuckets + int(usec>>uint(exp)) - histSubBuckets
+}
+
+// histUpper returns the largest latency, in microseconds, in bucket i.
+func histUpper(i int) uint64 {
+	if i < histSubBuckets {
+		return uint64(i)
+	}
+	exp := uint(i/histSubBuckets - 1)
+	sub := uint64(i%histSubBuckets + histSubBuckets)
+	return (sub+1)<<exp - 1
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	usec := uint64(d / time.Microsecond)
+	h.counts[histBucket(usec)]++
+	h.calls++
+	h.usec += usec
+}
+
+// percentile returns the latency in microseconds below which p percent of
+// the calls fall, rounded up to its bucket.
+func (h *latencyHistogram) percentile(p float64) uint64 {
+	rank := uint64(p / 100 * float64(h.calls))
+	if rank >= h.calls {
+		rank = h.calls - 1
+	}
+	var seen uint64
+	for i, n := range h.counts {
+		seen += n
+		if seen > rank {
+			return histUpper(i)
+		}
+	}
+	return 0
+}
+
+// commandStats counts the calls and latencies of each command.
+type commandStats struct {
+	mu   sync.Mutex
+	cmds map[string]*latencyHistogram
+}
+
+func (s *commandStats) record(name string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmds == nil {
+		s.cmds = make(map[string]*latencyHistogram)
+	}
+	h := s.cmds[name]
+	if h == nil {
+		h = &latencyHistogram{}
+		s.cmds[name] = h
+	}
+	h.record(d)
+}
+
+func (s *commandStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cmds = nil
+}
+
+// writeInfo writes the commandstats INFO section.
+func (s *commandStats) writeInfo(buf *bytes.Buffer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.cmds))
+	for name := range s.cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf.WriteString("# Commandstats\r\n")
+	for _, name := range names {
+		h := s.cmds[name]
+		fmt.Fprintf(buf, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,p50=%d,p99=%d,p999=%d\r\n",
+			name, h.calls, h.usec, float64(h.usec)/float64(h.calls),
+			h.percentile(50), h.percentile(99), h.percentile(99.9))
+	}
+}
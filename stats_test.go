@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistBuckets(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, usec := range []uint64{0, 3, 4, 7, 8, 9, 1000, 123456, 1 << 40} {
+		i := histBucket(usec)
+		assert.True(usec <= histUpper(i), "%d", usec)
+		if i > 0 {
+			assert.True(usec > histUpper(i-1), "%d", usec)
+		}
+	}
+	assert.Equal(histBuckets-1, histBucket(^uint64(0)))
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	assert := assert.New(t)
+
+	var h latencyHistogram
+	for i := 0; i < 99; i++ {
+		h.record(10 * time.Microsecond)
+	}
+	h.record(time.Second)
+	assert.Equal(uint64(11), h.percentile(50))
+	assert.Equal(uint64(11), h.percentile(98))
+	p999 := h.percentile(99.9)
+	assert.True(p999 >= 1000000 && p999 < 1250000, "%d", p999)
+}